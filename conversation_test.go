@@ -1,207 +1,466 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 	"testing"
-)
-
-func TestStartNewUser(t *testing.T) {
-	u := NewUserState()
-	u.Data = map[string]string{} // новый пользователь
 
-	reply := u.HandleCommandStart()
+	"github.com/Lvntt/go-persistent-conversation-bot/llm"
+	"github.com/Lvntt/go-persistent-conversation-bot/middleware"
+)
 
-	if u.State != StateChoosing {
-		t.Fatalf("expected state %q, got %q", StateChoosing, u.State)
-	}
-	if !strings.Contains(reply, "I will hold a more complex conversation with you") {
-		t.Fatalf("unexpected reply: %s", reply)
+func TestStartMessageNewUser(t *testing.T) {
+	l := catalog.Localizer("en")
+	msg := startMessage(l, map[string]string{})
+	if !strings.Contains(msg, "I will hold a more complex conversation with you") {
+		t.Fatalf("unexpected message: %s", msg)
 	}
 }
 
-func TestStartKnownUser(t *testing.T) {
-	u := NewUserState()
-	u.Data["age"] = "30"
-
-	reply := u.HandleCommandStart()
-
-	if !strings.Contains(reply, "You already told me your") {
-		t.Fatalf("expected mention of existing data, got: %s", reply)
+func TestStartMessageKnownUser(t *testing.T) {
+	l := catalog.Localizer("en")
+	msg := startMessage(l, map[string]string{"age": "30"})
+	if !strings.Contains(msg, "You already told me your") {
+		t.Fatalf("expected mention of existing data, got: %s", msg)
 	}
-	if !strings.Contains(reply, "age") {
-		t.Fatalf("expected key 'age' in reply, got: %s", reply)
+	if !strings.Contains(msg, "age") {
+		t.Fatalf("expected key 'age' in message, got: %s", msg)
 	}
 }
 
-func TestPredefinedFlow_Age(t *testing.T) {
+func TestProfileFlow_Age(t *testing.T) {
 	u := NewUserState()
-	u.Data = map[string]string{}
+	f := newProfileFlow()
 
-	// /start
-	_ = u.HandleCommandStart()
-	if u.State != StateChoosing {
-		t.Fatalf("expected state choosing after start, got %q", u.State)
+	reply, ok := f.RunCommand("start", "", u)
+	if !ok {
+		t.Fatalf("expected start command to be registered")
+	}
+	if u.State != stepChoosing {
+		t.Fatalf("expected state %q after start, got %q", stepChoosing, u.State)
+	}
+	if !reply.WithKeyboard() {
+		t.Fatalf("expected keyboard after start")
 	}
 
 	// выбираем Age
-	reply, withKeyboard, done := u.HandleText("Age")
-	if done {
+	reply, err := f.Step(u, "Age")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Done() {
 		t.Fatalf("conversation should not be done after choosing Age")
 	}
-	if u.State != StateTypingReply {
-		t.Fatalf("expected state typing_reply, got %q", u.State)
+	if u.State != stepTypingReply {
+		t.Fatalf("expected state %q, got %q", stepTypingReply, u.State)
 	}
-	if u.Choice != "age" {
-		t.Fatalf("expected choice 'age', got %q", u.Choice)
+	if u.Choice() != "age" {
+		t.Fatalf("expected choice 'age', got %q", u.Choice())
 	}
-	if !strings.Contains(reply, "Your age?") {
-		t.Fatalf("unexpected reply: %s", reply)
+	if !strings.Contains(reply.Text(), "Your age?") {
+		t.Fatalf("unexpected reply: %s", reply.Text())
 	}
-	if withKeyboard {
+	if reply.WithKeyboard() {
 		t.Fatalf("keyboard should not be shown at this step")
 	}
 
 	// вводим значение
-	reply, withKeyboard, done = u.HandleText("30")
-	if done {
+	reply, err = f.Step(u, "30")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Done() {
 		t.Fatalf("conversation should not be done yet")
 	}
-	if !withKeyboard {
+	if !reply.WithKeyboard() {
 		t.Fatalf("keyboard should be shown after saving info")
 	}
-	if u.State != StateChoosing {
-		t.Fatalf("expected state choosing, got %q", u.State)
+	if u.State != stepChoosing {
+		t.Fatalf("expected state %q, got %q", stepChoosing, u.State)
 	}
-	if v := u.Data["age"]; v != "30" {
+	if v := u.Facts()["age"]; v != "30" {
 		t.Fatalf("expected saved age '30', got %q", v)
 	}
-	if !strings.Contains(reply, "Neat! Just so you know") {
-		t.Fatalf("unexpected reply: %s", reply)
+	if !strings.Contains(reply.Text(), "Neat! Just so you know") {
+		t.Fatalf("unexpected reply: %s", reply.Text())
 	}
 
 	// Done
-	reply, withKeyboard, done = u.HandleText("Done")
-	if !done {
+	reply, err = f.Step(u, "Done")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reply.Done() {
 		t.Fatalf("conversation should be done after Done")
 	}
-	if withKeyboard {
+	if reply.WithKeyboard() {
 		t.Fatalf("keyboard should be removed after Done")
 	}
-	if !strings.Contains(reply, "I learned these facts about you") {
-		t.Fatalf("unexpected reply on Done: %s", reply)
+	if !strings.Contains(reply.Text(), "I learned these facts about you") {
+		t.Fatalf("unexpected reply on Done: %s", reply.Text())
 	}
 }
 
-func TestCustomCategoryFlow(t *testing.T) {
+func TestProfileFlow_CustomCategory(t *testing.T) {
 	u := NewUserState()
-	u.Data = map[string]string{}
+	f := newProfileFlow()
 
-	_ = u.HandleCommandStart()
+	if _, ok := f.RunCommand("start", "", u); !ok {
+		t.Fatalf("expected start command to be registered")
+	}
 
 	// Something else...
-	reply, withKeyboard, done := u.HandleText("Something else...")
-	if done {
+	reply, err := f.Step(u, "Something else...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Done() {
 		t.Fatalf("should not be done")
 	}
-	if withKeyboard {
+	if reply.WithKeyboard() {
 		t.Fatalf("keyboard should not be shown at this step")
 	}
-	if u.State != StateTypingChoice {
-		t.Fatalf("expected typing_choice, got %q", u.State)
+	if u.State != stepTypingChoice {
+		t.Fatalf("expected %q, got %q", stepTypingChoice, u.State)
 	}
-	if !strings.Contains(reply, "please send me the category first") {
-		t.Fatalf("unexpected reply: %s", reply)
+	if !strings.Contains(reply.Text(), "please send me the category first") {
+		t.Fatalf("unexpected reply: %s", reply.Text())
 	}
 
 	// отправляем название категории
-	reply, withKeyboard, done = u.HandleText("Most impressive skill")
-	if done {
+	reply, err = f.Step(u, "Most impressive skill")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Done() {
 		t.Fatalf("should not be done")
 	}
-	if u.State != StateTypingReply {
-		t.Fatalf("expected typing_reply, got %q", u.State)
+	if u.State != stepTypingReply {
+		t.Fatalf("expected %q, got %q", stepTypingReply, u.State)
 	}
-	if u.Choice != "most impressive skill" {
-		t.Fatalf("expected choice to be lowercased, got %q", u.Choice)
+	if u.Choice() != "most impressive skill" {
+		t.Fatalf("expected choice to be lowercased, got %q", u.Choice())
 	}
-	if !strings.Contains(reply, "Your most impressive skill?") {
-		t.Fatalf("unexpected reply: %s", reply)
+	if !strings.Contains(reply.Text(), "Your most impressive skill?") {
+		t.Fatalf("unexpected reply: %s", reply.Text())
 	}
 
 	// отправляем значение
-	reply, withKeyboard, done = u.HandleText("Go programming")
-	if done {
+	reply, err = f.Step(u, "Go programming")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Done() {
 		t.Fatalf("should not be done yet")
 	}
-	if !withKeyboard {
+	if !reply.WithKeyboard() {
 		t.Fatalf("keyboard should be shown after saving custom info")
 	}
-	if u.State != StateChoosing {
-		t.Fatalf("expected choosing, got %q", u.State)
+	if u.State != stepChoosing {
+		t.Fatalf("expected %q, got %q", stepChoosing, u.State)
 	}
-	if v := u.Data["most impressive skill"]; v != "go programming" {
+	if v := u.Facts()["most impressive skill"]; v != "go programming" {
 		t.Fatalf("expected saved value 'go programming', got %q", v)
 	}
-	if !strings.Contains(reply, "this is what you already told me") {
-		t.Fatalf("unexpected reply: %s", reply)
+	if !strings.Contains(reply.Text(), "this is what you already told me") {
+		t.Fatalf("unexpected reply: %s", reply.Text())
 	}
 }
 
-func TestStorageSaveLoad(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "state.json")
+func TestProfileFlow_InvalidChoiceReprompts(t *testing.T) {
+	u := NewUserState()
+	u.State = stepChoosing
+	f := newProfileFlow()
 
-	st := NewStorage(path)
+	reply, err := f.Step(u, "gibberish")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.State != stepChoosing {
+		t.Fatalf("expected to stay on %q, got %q", stepChoosing, u.State)
+	}
+	if !reply.WithKeyboard() {
+		t.Fatalf("expected keyboard to be shown again on invalid input")
+	}
+	if !strings.Contains(reply.Text(), `Please choose one of the options`) {
+		t.Fatalf("unexpected reply: %s", reply.Text())
+	}
+}
 
-	users := map[int64]*UserState{
-		42: {
-			State:  StateChoosing,
-			Choice: "",
-			Data: map[string]string{
-				"age": "30",
-			},
-		},
+func TestBotPersistsOnlyTouchedUser(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newStorage(dir, "json")
+	if err != nil {
+		t.Fatalf("newStorage error: %v", err)
+	}
+
+	bot, err := NewBot(nil, store)
+	if err != nil {
+		t.Fatalf("NewBot error: %v", err)
 	}
 
-	if err := st.Save(users); err != nil {
-		t.Fatalf("Save error: %v", err)
+	u := bot.getUserState(42)
+	u.SetFact("age", "30")
+	bot.saveUser(42)
+
+	// The write queue saves asynchronously; Close waits for it to drain.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
 	}
 
-	loaded, err := st.Load()
+	loaded, err := store.Load()
 	if err != nil {
 		t.Fatalf("Load error: %v", err)
 	}
+	rec, ok := loaded[42]
+	if !ok {
+		t.Fatalf("user 42 not found after save")
+	}
+	if rec.History == nil || rec.History.Facts()["age"] != "30" {
+		t.Fatalf("expected age 30 after load, got %+v", rec.History)
+	}
+}
+
+func TestBotUseDenylistBlocksHandler(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newStorage(dir, "json")
+	if err != nil {
+		t.Fatalf("newStorage error: %v", err)
+	}
+	defer store.Close()
+
+	bot, err := NewBot(nil, store)
+	if err != nil {
+		t.Fatalf("NewBot error: %v", err)
+	}
+	bot.Use(middleware.Denylist(42))
+
+	u := bot.getUserState(42)
+	var replied bool
+	ctx := middleware.NewContext(42, 42, "start", true, "start", "", u,
+		func(text string, opts ...middleware.ReplyOpt) { replied = true },
+		func() {},
+	)
+
+	if err := bot.chain(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replied {
+		t.Fatalf("expected the denylisted user's update to be dropped before reaching the handler")
+	}
+}
+
+func TestHistoryEditPreservesAuditTrailAndSwitchUndoesIt(t *testing.T) {
+	u := NewUserState()
+	f := newProfileFlow()
+
+	u.SetFact("age", "30")
+	original := u.History.Path()[0]
+
+	reply, ok := f.RunCommand("edit", original.Hash()+" 31", u)
+	if !ok {
+		t.Fatalf("expected edit command to be registered")
+	}
+	if !strings.Contains(reply.Text(), "Got it") {
+		t.Fatalf("unexpected edit reply: %s", reply.Text())
+	}
+	if u.Facts()["age"] != "31" {
+		t.Fatalf("expected age to become 31 after the edit, got %q", u.Facts()["age"])
+	}
+	if len(u.History.Messages) != 2 {
+		t.Fatalf("expected the original message to be kept, got %d messages", len(u.History.Messages))
+	}
+
+	reply, ok = f.RunCommand("history", "", u)
+	if !ok {
+		t.Fatalf("expected history command to be registered")
+	}
+	if strings.Count(reply.Text(), "\n") != 0 {
+		t.Fatalf("expected a single-line path (the edit replaced the only entry), got: %s", reply.Text())
+	}
 
-	if len(loaded) != 1 {
-		t.Fatalf("expected 1 user, got %d", len(loaded))
+	reply, ok = f.RunCommand("switch", original.Hash(), u)
+	if !ok {
+		t.Fatalf("expected switch command to be registered")
+	}
+	if !strings.Contains(reply.Text(), "Switched") {
+		t.Fatalf("unexpected switch reply: %s", reply.Text())
+	}
+	if u.History.HeadID != original.ID {
+		t.Fatalf("expected switch to move the head back to the original message")
 	}
-	u, ok := loaded[42]
+}
+
+func TestEditUnknownHashReportsNotFound(t *testing.T) {
+	u := NewUserState()
+	f := newProfileFlow()
+
+	reply, ok := f.RunCommand("edit", "nopehas new value", u)
 	if !ok {
-		t.Fatalf("user 42 not found after load")
+		t.Fatalf("expected edit command to be registered")
 	}
-	if v := u.Data["age"]; v != "30" {
-		t.Fatalf("expected age 30 after load, got %q", v)
+	if !strings.Contains(reply.Text(), "nopehas") {
+		t.Fatalf("expected the unknown hash to be echoed back, got: %s", reply.Text())
 	}
 }
 
-func TestStorageLoadNonExisting(t *testing.T) {
+func TestChatCommandsToggleModeAndForget(t *testing.T) {
+	u := NewUserState()
+	f := newProfileFlow()
+
+	if _, ok := f.RunCommand("chat", "", u); !ok {
+		t.Fatalf("expected chat command to be registered")
+	}
+	if u.Mode != modeChat {
+		t.Fatalf("expected mode %q after /chat, got %q", modeChat, u.Mode)
+	}
+
+	u.ChatHistory = []llm.Message{{Role: "user", Content: "hi"}}
+	if _, ok := f.RunCommand("forget", "", u); !ok {
+		t.Fatalf("expected forget command to be registered")
+	}
+	if u.ChatHistory != nil {
+		t.Fatalf("expected /forget to clear ChatHistory, got %+v", u.ChatHistory)
+	}
+
+	reply, ok := f.RunCommand("structured", "", u)
+	if !ok {
+		t.Fatalf("expected structured command to be registered")
+	}
+	if u.Mode != modeStructured {
+		t.Fatalf("expected mode %q after /structured, got %q", modeStructured, u.Mode)
+	}
+	if reply.Text() == "" {
+		t.Fatalf("expected a confirmation reply")
+	}
+}
+
+func TestTrimChatHistoryCapsWindow(t *testing.T) {
+	t.Setenv("CHAT_HISTORY_LIMIT", "3")
+
+	u := NewUserState()
+	for i := 0; i < 5; i++ {
+		u.ChatHistory = append(u.ChatHistory, llm.Message{Role: "user", Content: fmt.Sprintf("msg %d", i)})
+	}
+	trimChatHistory(u)
+
+	if len(u.ChatHistory) != 3 {
+		t.Fatalf("expected history trimmed to 3 messages, got %d", len(u.ChatHistory))
+	}
+	if u.ChatHistory[0].Content != "msg 2" {
+		t.Fatalf("expected the oldest messages to be dropped, got %+v", u.ChatHistory)
+	}
+}
+
+func TestHandleChatWithoutBackendReportsUnavailable(t *testing.T) {
 	dir := t.TempDir()
-	path := filepath.Join(dir, "no_such_file.json")
+	store, err := newStorage(dir, "json")
+	if err != nil {
+		t.Fatalf("newStorage error: %v", err)
+	}
+	defer store.Close()
 
-	st := NewStorage(path)
-	users, err := st.Load()
+	bot, err := NewBot(nil, store)
 	if err != nil {
-		t.Fatalf("Load should succeed for non-existing file, got error: %v", err)
+		t.Fatalf("NewBot error: %v", err)
 	}
-	if len(users) != 0 {
-		t.Fatalf("expected empty users for non-existing file, got %d", len(users))
+
+	u := bot.getUserState(42)
+	u.Mode = modeChat
+
+	var reply string
+	ctx := middleware.NewContext(42, 42, "hello", false, "", "", u,
+		func(text string, opts ...middleware.ReplyOpt) { reply = text },
+		func() {},
+	)
+
+	if err := bot.handleChat(ctx, u); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(reply, "isn't configured") {
+		t.Fatalf("expected an unavailable reply, got: %q", reply)
+	}
+}
+
+func TestSubscribeReceivesMessageCommandAndStateTransitionEvents(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newStorage(dir, "json")
+	if err != nil {
+		t.Fatalf("newStorage error: %v", err)
+	}
+	defer store.Close()
+
+	bot, err := NewBot(nil, store)
+	if err != nil {
+		t.Fatalf("NewBot error: %v", err)
+	}
+	sub := bot.Subscribe()
+	defer sub.Shutdown()
+
+	u := bot.getUserState(42)
+	ctx := middleware.NewContext(42, 42, "/start", true, "start", "", u,
+		func(text string, opts ...middleware.ReplyOpt) {},
+		func() {},
+	)
+	if err := bot.chain(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case e := <-sub.Messages():
+		if e.UserID != 42 || e.Text != "/start" {
+			t.Fatalf("unexpected MessageEvent: %+v", e)
+		}
+	default:
+		t.Fatalf("expected a MessageEvent")
 	}
+
+	select {
+	case e := <-sub.Commands():
+		if e.Command != "start" {
+			t.Fatalf("unexpected CommandEvent: %+v", e)
+		}
+	default:
+		t.Fatalf("expected a CommandEvent")
+	}
+
+	select {
+	case e := <-sub.StateTransitions():
+		if e.To != stepChoosing {
+			t.Fatalf("unexpected StateTransitionEvent: %+v", e)
+		}
+	default:
+		t.Fatalf("expected a StateTransitionEvent")
+	}
+}
+
+func TestSubscriptionShutdownStopsDelivery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newStorage(dir, "json")
+	if err != nil {
+		t.Fatalf("newStorage error: %v", err)
+	}
+	defer store.Close()
+
+	bot, err := NewBot(nil, store)
+	if err != nil {
+		t.Fatalf("NewBot error: %v", err)
+	}
+	sub := bot.Subscribe()
+	sub.Shutdown()
+
+	if len(bot.subscribers()) != 0 {
+		t.Fatalf("expected Shutdown to unsubscribe, got %d subscribers", len(bot.subscribers()))
+	}
+
+	// Publishing after Shutdown must not touch (or panic on) the closed
+	// channels of an unsubscribed Subscription.
+	bot.publishMessage(MessageEvent{UserID: 1})
 }
 
 func TestFactsToStrEmpty(t *testing.T) {
-	s := factsToStr(map[string]string{})
+	s := factsToStr(map[string]string{}, catalog.Localizer("en"))
 	if s != "\n\n" {
 		t.Fatalf("expected two newlines, got %q", s)
 	}
@@ -210,4 +469,4 @@ func TestFactsToStrEmpty(t *testing.T) {
 func TestMainNoToken(t *testing.T) {
 	// Просто проверяем, что отсутствие TELEGRAM_TOKEN не приводит к панике при чтении env
 	_ = os.Getenv("TELEGRAM_TOKEN")
-}
\ No newline at end of file
+}
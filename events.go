@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// eventBufferSize is how many pending events each Subscription channel
+// holds before a slow consumer starts dropping events instead of blocking
+// the bot's update loop.
+const eventBufferSize = 250
+
+// MessageEvent reports a single incoming Telegram message, whether or not
+// it turned out to be a command.
+type MessageEvent struct {
+	UserID int64
+	ChatID int64
+	Text   string
+}
+
+// CommandEvent reports a single incoming bot command.
+type CommandEvent struct {
+	UserID  int64
+	ChatID  int64
+	Command string
+	Args    string
+}
+
+// StateTransitionEvent reports a user's flow step changing while handling
+// an update. From and To are flow step names (see flow.State.CurrentStep);
+// it is only published when To differs from From, so handlers that merely
+// reprompt the current step don't generate one.
+type StateTransitionEvent struct {
+	UserID int64
+	ChatID int64
+	From   string
+	To     string
+}
+
+// Subscription is a typed view onto a Bot's update stream: an integration
+// test, metrics exporter, or other out-of-process observer can read its
+// channels instead of scraping reply strings or touching handleMessage.
+//
+// Each channel is buffered at eventBufferSize. A send that would block
+// because a channel's buffer is full is dropped instead, and recorded as
+// an error on Errors() — a slow consumer can never stall the bot's update
+// loop.
+type Subscription struct {
+	messages         chan MessageEvent
+	commands         chan CommandEvent
+	stateTransitions chan StateTransitionEvent
+	errs             chan error
+
+	bot *Bot
+}
+
+func newSubscription(b *Bot) *Subscription {
+	return &Subscription{
+		messages:         make(chan MessageEvent, eventBufferSize),
+		commands:         make(chan CommandEvent, eventBufferSize),
+		stateTransitions: make(chan StateTransitionEvent, eventBufferSize),
+		errs:             make(chan error, eventBufferSize),
+		bot:              b,
+	}
+}
+
+// Messages returns every incoming message, command or not, that reaches the
+// bot's base handler; updates a middleware drops are not reported.
+func (s *Subscription) Messages() <-chan MessageEvent { return s.messages }
+
+// Commands returns every incoming bot command that reaches the bot's base
+// handler; commands a middleware drops are not reported.
+func (s *Subscription) Commands() <-chan CommandEvent { return s.commands }
+
+// StateTransitions returns every flow step change handling an update caused.
+func (s *Subscription) StateTransitions() <-chan StateTransitionEvent { return s.stateTransitions }
+
+// Errors returns operational errors: handler failures, and notices that an
+// event was dropped because this Subscription's consumer fell behind.
+func (s *Subscription) Errors() <-chan error { return s.errs }
+
+// Shutdown unsubscribes s from its Bot and closes its channels. It must be
+// called exactly once, and no further reads should follow.
+func (s *Subscription) Shutdown() {
+	s.bot.unsubscribe(s)
+	close(s.messages)
+	close(s.commands)
+	close(s.stateTransitions)
+	close(s.errs)
+}
+
+func (s *Subscription) publishMessage(e MessageEvent) {
+	select {
+	case s.messages <- e:
+	default:
+		s.publishError(fmt.Errorf("events: dropped MessageEvent for user %d, consumer too slow", e.UserID))
+	}
+}
+
+func (s *Subscription) publishCommand(e CommandEvent) {
+	select {
+	case s.commands <- e:
+	default:
+		s.publishError(fmt.Errorf("events: dropped CommandEvent /%s for user %d, consumer too slow", e.Command, e.UserID))
+	}
+}
+
+func (s *Subscription) publishStateTransition(e StateTransitionEvent) {
+	select {
+	case s.stateTransitions <- e:
+	default:
+		s.publishError(fmt.Errorf("events: dropped StateTransitionEvent for user %d, consumer too slow", e.UserID))
+	}
+}
+
+func (s *Subscription) publishError(err error) {
+	select {
+	case s.errs <- err:
+	default:
+		log.Printf("events: dropped error, Errors() consumer too slow: %v", err)
+	}
+}
+
+// Subscribe registers a new Subscription that receives every event the bot
+// publishes from this point on, until its Shutdown is called.
+func (b *Bot) Subscribe() *Subscription {
+	s := newSubscription(b)
+	b.subsMu.Lock()
+	b.subs = append(b.subs, s)
+	b.subsMu.Unlock()
+	return s
+}
+
+func (b *Bot) unsubscribe(s *Subscription) {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Bot) subscribers() []*Subscription {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	return append([]*Subscription(nil), b.subs...)
+}
+
+func (b *Bot) publishMessage(e MessageEvent) {
+	for _, s := range b.subscribers() {
+		s.publishMessage(e)
+	}
+}
+
+func (b *Bot) publishCommand(e CommandEvent) {
+	for _, s := range b.subscribers() {
+		s.publishCommand(e)
+	}
+}
+
+func (b *Bot) publishStateTransition(e StateTransitionEvent) {
+	for _, s := range b.subscribers() {
+		s.publishStateTransition(e)
+	}
+}
+
+func (b *Bot) publishError(err error) {
+	for _, s := range b.subscribers() {
+		s.publishError(err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package flow provides a small fluent builder for declaring multi-step,
+// branching conversational dialogs instead of hand-rolled switches over a
+// state string. A Flow is built once at startup and then driven per user by
+// calling Step with whatever the user just typed; persistence of the
+// current step name is left entirely to the caller via the State
+// interface, so it naturally rides along with whatever storage already
+// tracks user state.
+package flow
+
+import "fmt"
+
+// State is the per-user state a Flow reads and mutates as it advances.
+// Callers implement it on top of their own persisted user record.
+type State interface {
+	CurrentStep() string
+	SetStep(name string)
+	Facts() map[string]string
+	Fact(key string) (string, bool)
+	SetFact(key, value string)
+	Choice() string
+	SetChoice(choice string)
+	// Lang is the user's language, used by handlers that render localized
+	// replies. The flow itself never inspects it.
+	Lang() string
+}
+
+// Reply is the outgoing message a step or command produces. Zero value is a
+// reply with no text, which callers should treat as "say nothing".
+type Reply struct {
+	text     string
+	buttons  []string
+	keyboard bool
+	done     bool
+}
+
+// NewReply returns an empty Reply for command handlers to fill in.
+func NewReply() *Reply { return &Reply{} }
+
+// Message sets the text shown to the user.
+func (r *Reply) Message(text string) *Reply {
+	r.text = text
+	return r
+}
+
+// AddButton appends a button to the reply keyboard.
+func (r *Reply) AddButton(label string) *Reply {
+	r.buttons = append(r.buttons, label)
+	return r
+}
+
+// ShowKeyboard marks the reply as one that should (re)display the keyboard.
+func (r *Reply) ShowKeyboard() *Reply {
+	r.keyboard = true
+	return r
+}
+
+// Text returns the reply's message text.
+func (r Reply) Text() string { return r.text }
+
+// Buttons returns the reply's keyboard buttons, if any.
+func (r Reply) Buttons() []string { return r.buttons }
+
+// WithKeyboard reports whether the keyboard should be shown.
+func (r Reply) WithKeyboard() bool { return r.keyboard }
+
+// Done reports whether this reply concludes the flow.
+func (r Reply) Done() bool { return r.done }
+
+// Handler processes the user's text while the conversation sits at a given
+// step. It returns the name of the step to move to next; an empty string
+// means "stay on the current step" (handy for reprompting on bad input).
+// Returning a step name other than the one that would follow in the
+// sequence the builder was called in is how branching works.
+type Handler func(r *Reply, text string, s State) (next string, err error)
+
+type step struct {
+	name     string
+	prompt   string
+	buttons  []string
+	handler  Handler
+	terminal bool
+}
+
+// Flow is a declarative, branching multi-step dialog.
+type Flow struct {
+	name     string
+	steps    map[string]*step
+	commands map[string]func(State, string) Reply
+	pending  *step
+	start    string
+}
+
+// New starts building a Flow identified by name (used in error messages).
+func New(name string) *Flow {
+	return &Flow{
+		name:     name,
+		steps:    make(map[string]*step),
+		commands: make(map[string]func(State, string) Reply),
+	}
+}
+
+// Command registers a handler for a bot command (without the leading "/")
+// that can be run at any time, regardless of which step the user is on. fn
+// receives whatever text followed the command name, e.g. "31" for
+// "/edit a1b2c3d 31".
+func (f *Flow) Command(cmd string, fn func(State, string) Reply) *Flow {
+	f.commands[cmd] = fn
+	return f
+}
+
+// Prompt declares a step named name whose message is text, shown with the
+// given buttons. The first Prompt in a builder chain becomes the step a
+// fresh user starts on. Must be followed by Next to attach its handler.
+func (f *Flow) Prompt(name, text string, buttons ...string) *Flow {
+	st := &step{name: name, prompt: text, buttons: buttons}
+	f.steps[name] = st
+	if f.start == "" {
+		f.start = name
+	}
+	f.pending = st
+	return f
+}
+
+// Next attaches the handler that processes replies sent while the user is
+// on the step most recently declared with Prompt.
+func (f *Flow) Next(h Handler) *Flow {
+	if f.pending == nil {
+		panic("flow: Next called without a preceding Prompt")
+	}
+	f.pending.handler = h
+	f.pending = nil
+	return f
+}
+
+// End declares a terminal step: reaching it marks the Reply as Done.
+func (f *Flow) End(name, text string) *Flow {
+	f.steps[name] = &step{name: name, prompt: text, terminal: true}
+	return f
+}
+
+// StartStep returns the name of the first step declared with Prompt.
+func (f *Flow) StartStep() string { return f.start }
+
+// RunCommand dispatches a registered command for the given state, passing
+// along args (the text following the command name). The second return
+// value is false if no handler was registered for cmd.
+func (f *Flow) RunCommand(cmd, args string, s State) (Reply, bool) {
+	fn, ok := f.commands[cmd]
+	if !ok {
+		return Reply{}, false
+	}
+	return fn(s, args), true
+}
+
+// Step advances the flow for a user's free-text reply: it looks up the
+// step the user is currently on (defaulting to StartStep for a fresh
+// user), runs that step's handler, and follows whichever step name the
+// handler returns.
+func (f *Flow) Step(s State, text string) (Reply, error) {
+	name := s.CurrentStep()
+	if name == "" {
+		name = f.start
+	}
+	cur, ok := f.steps[name]
+	if !ok {
+		return Reply{}, fmt.Errorf("flow %s: unknown step %q", f.name, name)
+	}
+	if cur.handler == nil {
+		// A terminal step has nowhere to dispatch a free-text reply to.
+		// Re-seed the conversation at StartStep instead of wedging it here
+		// forever, mirroring how the original hand-rolled switch's default
+		// case reset state to StateChoosing and re-ran handleChoosing.
+		name = f.start
+		cur, ok = f.steps[name]
+		if !ok {
+			return Reply{}, fmt.Errorf("flow %s: unknown start step %q", f.name, name)
+		}
+		s.SetStep(name)
+		if cur.handler == nil {
+			return Reply{text: cur.prompt, buttons: cur.buttons}, nil
+		}
+	}
+
+	r := &Reply{}
+	next, err := cur.handler(r, text, s)
+	if err != nil {
+		return Reply{}, err
+	}
+	if next == "" {
+		next = name
+	}
+	target, ok := f.steps[next]
+	if !ok {
+		return Reply{}, fmt.Errorf("flow %s: step %q returned unknown next step %q", f.name, name, next)
+	}
+
+	s.SetStep(next)
+	if r.text == "" {
+		r.text = target.prompt
+	}
+	if len(r.buttons) == 0 {
+		r.buttons = target.buttons
+	}
+	if target.terminal {
+		r.done = true
+	}
+	return *r, nil
+}
@@ -0,0 +1,145 @@
+package flow
+
+import "testing"
+
+// fakeState is a minimal State implementation for exercising a Flow in
+// isolation from any concrete bot storage.
+type fakeState struct {
+	step   string
+	choice string
+	data   map[string]string
+}
+
+func newFakeState() *fakeState { return &fakeState{data: make(map[string]string)} }
+
+func (s *fakeState) CurrentStep() string          { return s.step }
+func (s *fakeState) SetStep(name string)          { s.step = name }
+func (s *fakeState) Facts() map[string]string     { return s.data }
+func (s *fakeState) Fact(k string) (string, bool) { v, ok := s.data[k]; return v, ok }
+func (s *fakeState) SetFact(k, v string)          { s.data[k] = v }
+func (s *fakeState) Choice() string               { return s.choice }
+func (s *fakeState) SetChoice(c string)           { s.choice = c }
+func (s *fakeState) Lang() string                 { return "" }
+
+func buildTestFlow() *Flow {
+	return New("test").
+		Prompt("ask_name", "What's your name?").
+		Next(func(r *Reply, text string, s State) (string, error) {
+			s.SetFact("name", text)
+			if text == "skip" {
+				return "bye", nil
+			}
+			return "ask_age", nil
+		}).
+		Prompt("ask_age", "How old are you?").
+		Next(func(r *Reply, text string, s State) (string, error) {
+			s.SetFact("age", text)
+			return "bye", nil
+		}).
+		End("bye", "Goodbye!")
+}
+
+func TestFlowLinearProgression(t *testing.T) {
+	f := buildTestFlow()
+	s := newFakeState()
+
+	reply, err := f.Step(s, "Alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.CurrentStep() != "ask_age" {
+		t.Fatalf("expected step ask_age, got %q", s.CurrentStep())
+	}
+	if reply.Text() != "How old are you?" {
+		t.Fatalf("unexpected reply: %q", reply.Text())
+	}
+
+	reply, err = f.Step(s, "30")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reply.Done() {
+		t.Fatalf("expected final reply to be Done")
+	}
+	if reply.Text() != "Goodbye!" {
+		t.Fatalf("unexpected reply: %q", reply.Text())
+	}
+	if s.Facts()["name"] != "Alice" || s.Facts()["age"] != "30" {
+		t.Fatalf("unexpected facts: %+v", s.Facts())
+	}
+}
+
+func TestFlowBranching(t *testing.T) {
+	f := buildTestFlow()
+	s := newFakeState()
+
+	reply, err := f.Step(s, "skip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reply.Done() {
+		t.Fatalf("expected branch to jump straight to the terminal step")
+	}
+	if s.CurrentStep() != "bye" {
+		t.Fatalf("expected step bye, got %q", s.CurrentStep())
+	}
+}
+
+func TestFlowStaysOnEmptyNextStep(t *testing.T) {
+	f := New("test").
+		Prompt("only", "Pick one").
+		Next(func(r *Reply, text string, s State) (string, error) {
+			return "", nil
+		})
+	s := newFakeState()
+
+	reply, err := f.Step(s, "anything")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.CurrentStep() != "only" {
+		t.Fatalf("expected to stay on step only, got %q", s.CurrentStep())
+	}
+	if reply.Text() != "Pick one" {
+		t.Fatalf("expected fallback prompt text, got %q", reply.Text())
+	}
+}
+
+func TestFlowRecoversFromTerminalStep(t *testing.T) {
+	f := buildTestFlow()
+	s := newFakeState()
+	s.SetStep("bye")
+
+	reply, err := f.Step(s, "hello again")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.CurrentStep() != "ask_age" {
+		t.Fatalf("expected the flow to re-seed at StartStep and process the reply, got step %q", s.CurrentStep())
+	}
+	if reply.Done() {
+		t.Fatalf("expected the re-seeded reply not to be Done")
+	}
+	if s.Facts()["name"] != "hello again" {
+		t.Fatalf("expected the free-text reply to be handled by StartStep, got facts %+v", s.Facts())
+	}
+}
+
+func TestFlowUnknownStepReturnsError(t *testing.T) {
+	f := New("test").Prompt("only", "Pick one").Next(func(r *Reply, text string, s State) (string, error) {
+		return "", nil
+	})
+	s := newFakeState()
+	s.SetStep("nope")
+
+	if _, err := f.Step(s, "anything"); err == nil {
+		t.Fatalf("expected error for unknown current step")
+	}
+}
+
+func TestRunCommandUnregistered(t *testing.T) {
+	f := New("test")
+	if _, ok := f.RunCommand("missing", "", newFakeState()); ok {
+		t.Fatalf("expected RunCommand to report false for an unregistered command")
+	}
+}
@@ -0,0 +1,165 @@
+// Package history models a user's conversation facts as an append-only
+// tree of Messages, so editing a previously given answer creates a new
+// branch instead of overwriting it. A Tree's HeadID marks the branch
+// currently in effect; Edit and Switch move it, but no Message is ever
+// removed, so old answers stay around to switch back to.
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message is a single node in a user's conversation tree. A zero ParentID
+// (uuid.Nil) marks a root message, one with no answer before it.
+type Message struct {
+	ID        uuid.UUID `json:"id"`
+	ParentID  uuid.UUID `json:"parent_id"`
+	Role      string    `json:"role"`
+	Category  string    `json:"category"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Hash is the short, git-style identifier shown to users in place of the
+// full UUID, e.g. in /history output or as the argument to /edit.
+func (m Message) Hash() string {
+	return strings.ReplaceAll(m.ID.String(), "-", "")[:7]
+}
+
+// Tree is the append-only set of Messages for one user, plus a pointer to
+// the message conversation state is currently anchored to.
+type Tree struct {
+	Messages []Message `json:"messages"`
+	HeadID   uuid.UUID `json:"head_id"`
+}
+
+// NewTree returns an empty Tree.
+func NewTree() *Tree {
+	return &Tree{}
+}
+
+// FromFlatMap builds a Tree out of the flat `data[category]=value` shape
+// the bot used before history tracking existed, for migrating users saved
+// under that format. Entries are chained, in key order, into a single
+// branch, so Facts below recovers exactly the map it was built from.
+func FromFlatMap(data map[string]string) *Tree {
+	t := NewTree()
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.Append("user", k, data[k])
+	}
+	return t
+}
+
+// Append adds a new message as a child of the current head, moves the head
+// to it, and returns it.
+func (t *Tree) Append(role, category, text string) Message {
+	m := Message{
+		ID:        uuid.New(),
+		ParentID:  t.HeadID,
+		Role:      role,
+		Category:  category,
+		Text:      text,
+		CreatedAt: time.Now(),
+	}
+	t.Messages = append(t.Messages, m)
+	t.HeadID = m.ID
+	return m
+}
+
+func (t *Tree) get(id uuid.UUID) (Message, bool) {
+	for _, m := range t.Messages {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+// FindByHash looks up a message by its short Hash.
+func (t *Tree) FindByHash(hash string) (Message, bool) {
+	for _, m := range t.Messages {
+		if m.Hash() == hash {
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+// Path returns every message from the root to the current head, in that
+// order.
+func (t *Tree) Path() []Message {
+	var path []Message
+	for id := t.HeadID; id != uuid.Nil; {
+		m, ok := t.get(id)
+		if !ok {
+			break
+		}
+		path = append(path, m)
+		id = m.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Facts derives the "current facts" view: the latest value for each
+// category along the current head->root path.
+func (t *Tree) Facts() map[string]string {
+	facts := make(map[string]string)
+	for _, m := range t.Path() {
+		facts[m.Category] = m.Text
+	}
+	return facts
+}
+
+// Fact returns the current value for category, if any.
+func (t *Tree) Fact(category string) (string, bool) {
+	v, ok := t.Facts()[category]
+	return v, ok
+}
+
+// Edit creates a sibling of the message identified by hash, under the same
+// parent, with newText in place of the original, and moves the head to it.
+// The edited message, and anything that had been built on top of it, stays
+// in the tree but falls off the active branch — exactly the "regenerate
+// from this point" behaviour: later answers given after the edited one are
+// preserved, just no longer part of Facts, and still reachable via Switch.
+func (t *Tree) Edit(hash, newText string) (Message, error) {
+	target, ok := t.FindByHash(hash)
+	if !ok {
+		return Message{}, fmt.Errorf("history: no message with hash %q", hash)
+	}
+	m := Message{
+		ID:        uuid.New(),
+		ParentID:  target.ParentID,
+		Role:      target.Role,
+		Category:  target.Category,
+		Text:      newText,
+		CreatedAt: time.Now(),
+	}
+	t.Messages = append(t.Messages, m)
+	t.HeadID = m.ID
+	return m, nil
+}
+
+// Switch moves the head to the message identified by hash, without
+// creating a new message.
+func (t *Tree) Switch(hash string) error {
+	target, ok := t.FindByHash(hash)
+	if !ok {
+		return fmt.Errorf("history: no message with hash %q", hash)
+	}
+	t.HeadID = target.ID
+	return nil
+}
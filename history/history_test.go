@@ -0,0 +1,114 @@
+package history
+
+import "testing"
+
+func TestAppendMovesHead(t *testing.T) {
+	tr := NewTree()
+	age := tr.Append("user", "age", "30")
+	if tr.HeadID != age.ID {
+		t.Fatalf("expected head to move to the new message")
+	}
+	colour := tr.Append("user", "favourite_colour", "blue")
+	if colour.ParentID != age.ID {
+		t.Fatalf("expected %q to be the parent of the new message", age.Hash())
+	}
+}
+
+func TestFactsWalksHeadToRoot(t *testing.T) {
+	tr := NewTree()
+	tr.Append("user", "age", "30")
+	tr.Append("user", "favourite_colour", "blue")
+
+	facts := tr.Facts()
+	if facts["age"] != "30" || facts["favourite_colour"] != "blue" {
+		t.Fatalf("unexpected facts: %+v", facts)
+	}
+}
+
+func TestFactsKeepsLatestPerCategory(t *testing.T) {
+	tr := NewTree()
+	tr.Append("user", "age", "30")
+	tr.Append("user", "age", "31")
+
+	v, ok := tr.Fact("age")
+	if !ok || v != "31" {
+		t.Fatalf("expected latest age 31, got %q (ok=%v)", v, ok)
+	}
+	if len(tr.Path()) != 2 {
+		t.Fatalf("expected both messages to remain on the path, got %d", len(tr.Path()))
+	}
+}
+
+func TestEditCreatesSiblingAndMovesHead(t *testing.T) {
+	tr := NewTree()
+	age := tr.Append("user", "age", "30")
+
+	edited, err := tr.Edit(age.Hash(), "31")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if edited.ParentID != age.ParentID {
+		t.Fatalf("expected edit to share the original's parent")
+	}
+	if tr.HeadID != edited.ID {
+		t.Fatalf("expected head to move to the edited message")
+	}
+	if v, _ := tr.Fact("age"); v != "31" {
+		t.Fatalf("expected edited value to win, got %q", v)
+	}
+	if len(tr.Messages) != 2 {
+		t.Fatalf("expected the original message to be preserved, got %d messages", len(tr.Messages))
+	}
+}
+
+func TestEditDropsDescendantsFromFacts(t *testing.T) {
+	tr := NewTree()
+	age := tr.Append("user", "age", "30")
+	tr.Append("user", "favourite_colour", "blue")
+
+	if _, err := tr.Edit(age.Hash(), "31"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := tr.Fact("favourite_colour"); ok {
+		t.Fatalf("expected favourite_colour to fall off the active branch after editing an earlier message")
+	}
+}
+
+func TestEditUnknownHash(t *testing.T) {
+	tr := NewTree()
+	if _, err := tr.Edit("nope", "x"); err == nil {
+		t.Fatalf("expected error for unknown hash")
+	}
+}
+
+func TestSwitchMovesHeadWithoutNewMessage(t *testing.T) {
+	tr := NewTree()
+	age := tr.Append("user", "age", "30")
+	tr.Append("user", "age", "31")
+
+	if err := tr.Switch(age.Hash()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tr.HeadID != age.ID {
+		t.Fatalf("expected head to move back to %q", age.Hash())
+	}
+	if len(tr.Messages) != 2 {
+		t.Fatalf("switch should not create a new message, got %d", len(tr.Messages))
+	}
+}
+
+func TestSwitchUnknownHash(t *testing.T) {
+	tr := NewTree()
+	if err := tr.Switch("nope"); err == nil {
+		t.Fatalf("expected error for unknown hash")
+	}
+}
+
+func TestFromFlatMapRecoversFacts(t *testing.T) {
+	tr := FromFlatMap(map[string]string{"age": "30", "favourite_colour": "blue"})
+	facts := tr.Facts()
+	if facts["age"] != "30" || facts["favourite_colour"] != "blue" {
+		t.Fatalf("unexpected facts after migration: %+v", facts)
+	}
+}
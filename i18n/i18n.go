@@ -0,0 +1,126 @@
+// Package i18n loads message catalogs from TOML files and renders them per
+// user language, with text/template support for variables.
+package i18n
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+// catalogFile is the shape of a single locales/<lang>.toml file.
+type catalogFile struct {
+	Messages map[string]string `toml:"messages"`
+	Buttons  map[string]string `toml:"buttons"`
+}
+
+// Catalog holds every loaded locale's message templates, keyed by message
+// ID (button labels are stored under the "button.<id>" message ID).
+type Catalog struct {
+	messages map[string]map[string]string
+	fallback string
+}
+
+// LoadDir loads every <lang>.toml file in dir into a Catalog; the file
+// name without its extension becomes the locale code (locales/ru.toml ->
+// "ru"). fallback is the locale used when a user's language isn't loaded,
+// or a message is missing from their locale.
+func LoadDir(dir, fallback string) (*Catalog, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Catalog{messages: make(map[string]map[string]string), fallback: fallback}
+	for _, f := range files {
+		lang := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var doc catalogFile
+		if _, err := toml.Decode(string(b), &doc); err != nil {
+			return nil, fmt.Errorf("i18n: parse %s: %w", f, err)
+		}
+
+		merged := make(map[string]string, len(doc.Messages)+len(doc.Buttons))
+		for id, text := range doc.Messages {
+			merged[id] = text
+		}
+		for id, text := range doc.Buttons {
+			merged["button."+id] = text
+		}
+		c.messages[lang] = merged
+	}
+
+	if _, ok := c.messages[fallback]; !ok {
+		return nil, fmt.Errorf("i18n: fallback locale %q not found in %s", fallback, dir)
+	}
+	return c, nil
+}
+
+// Localizer renders messages for one user's language.
+type Localizer struct {
+	catalog *Catalog
+	lang    string
+}
+
+// Localizer returns a Localizer for lang, falling back to the catalog's
+// default locale if lang wasn't loaded.
+func (c *Catalog) Localizer(lang string) *Localizer {
+	if _, ok := c.messages[lang]; !ok {
+		lang = c.fallback
+	}
+	return &Localizer{catalog: c, lang: lang}
+}
+
+// T renders the message registered under id as a text/template, with data
+// as its context. It falls back to the catalog's default locale if id is
+// missing from the user's locale, and to id itself if it's missing there too.
+func (l *Localizer) T(id string, data any) string {
+	text, ok := l.catalog.messages[l.lang][id]
+	if !ok {
+		text, ok = l.catalog.messages[l.catalog.fallback][id]
+	}
+	if !ok {
+		return id
+	}
+
+	tmpl, err := template.New(id).Parse(text)
+	if err != nil {
+		return text
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return text
+	}
+	return buf.String()
+}
+
+// Button renders the localized label for a button id, e.g. Button("age")
+// -> "Age" in en, "Возраст" in ru.
+func (l *Localizer) Button(id string) string {
+	return l.T("button."+id, nil)
+}
+
+// ButtonID resolves text typed by the user back to the canonical button id
+// it came from, checking every loaded locale rather than just the user's
+// current one — so "Age", "Возраст" and a Chinese label all resolve to
+// "age" regardless of which language rendered the keyboard the user is
+// replying to.
+func (l *Localizer) ButtonID(text string, ids []string) (string, bool) {
+	for _, id := range ids {
+		for _, localeMessages := range l.catalog.messages {
+			if localeMessages["button."+id] == text {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
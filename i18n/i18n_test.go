@@ -0,0 +1,75 @@
+package i18n
+
+import "testing"
+
+func TestTRendersTemplateForLocale(t *testing.T) {
+	c, err := LoadDir("testdata", "en")
+	if err != nil {
+		t.Fatalf("LoadDir error: %v", err)
+	}
+
+	en := c.Localizer("en")
+	if got := en.T("greeting", map[string]string{"Name": "Alice"}); got != "Hello, Alice!" {
+		t.Fatalf("unexpected message: %q", got)
+	}
+
+	ru := c.Localizer("ru")
+	if got := ru.T("greeting", map[string]string{"Name": "Алиса"}); got != "Привет, Алиса!" {
+		t.Fatalf("unexpected message: %q", got)
+	}
+}
+
+func TestTFallsBackToDefaultLocale(t *testing.T) {
+	c, err := LoadDir("testdata", "en")
+	if err != nil {
+		t.Fatalf("LoadDir error: %v", err)
+	}
+
+	ru := c.Localizer("ru")
+	if got := ru.T("only_in_english", nil); got != "English only" {
+		t.Fatalf("expected fallback to English, got %q", got)
+	}
+}
+
+func TestLocalizerFallsBackToDefaultLocaleForUnknownLang(t *testing.T) {
+	c, err := LoadDir("testdata", "en")
+	if err != nil {
+		t.Fatalf("LoadDir error: %v", err)
+	}
+
+	fr := c.Localizer("fr")
+	if got := fr.T("greeting", map[string]string{"Name": "Bob"}); got != "Hello, Bob!" {
+		t.Fatalf("expected unknown locale to fall back to en, got %q", got)
+	}
+}
+
+func TestTReturnsIDForUnknownMessage(t *testing.T) {
+	c, err := LoadDir("testdata", "en")
+	if err != nil {
+		t.Fatalf("LoadDir error: %v", err)
+	}
+	if got := c.Localizer("en").T("nope.missing", nil); got != "nope.missing" {
+		t.Fatalf("expected missing message to render as its own id, got %q", got)
+	}
+}
+
+func TestButtonIDMatchesAnyLoadedLocale(t *testing.T) {
+	c, err := LoadDir("testdata", "en")
+	if err != nil {
+		t.Fatalf("LoadDir error: %v", err)
+	}
+
+	l := c.Localizer("en")
+	if id, ok := l.ButtonID("Возраст", []string{"age"}); !ok || id != "age" {
+		t.Fatalf("expected Russian label to resolve to id 'age', got %q, %v", id, ok)
+	}
+	if _, ok := l.ButtonID("nonsense", []string{"age"}); ok {
+		t.Fatalf("expected no match for unrecognized text")
+	}
+}
+
+func TestLoadDirErrorsWithoutFallbackLocale(t *testing.T) {
+	if _, err := LoadDir("testdata", "de"); err == nil {
+		t.Fatalf("expected an error when the fallback locale isn't loaded")
+	}
+}
@@ -0,0 +1,42 @@
+// Package llm defines the interface the bot's free-form chat mode talks to,
+// plus two implementations: an OpenAI-compatible HTTP backend and Ollama.
+// Both stream their reply incrementally so the bot can edit a single
+// Telegram message as tokens arrive instead of waiting for the whole
+// completion.
+package llm
+
+import "context"
+
+// Message is one turn of a chat-style conversation, e.g. {"user", "hi"} or
+// {"system", "You are a helpful assistant."}.
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Chunk is one piece of a streamed completion. Err is set, and Content
+// left empty, if the stream failed partway through; the channel is closed
+// either way once the completion ends.
+type Chunk struct {
+	Content string
+	Err     error
+}
+
+// Options configures a single Complete call.
+type Options struct {
+	// Model overrides the backend's configured default model for this
+	// call, if set.
+	Model string
+	// Temperature, if non-zero, is forwarded to the backend's sampling
+	// parameters.
+	Temperature float64
+}
+
+// Backend streams a chat completion for msgs. Complete itself only returns
+// an error when the request cannot be made (bad URL, connection refused)
+// or is answered with a non-200 status; once the channel is handed back, a
+// failure partway through the stream surfaces as the last Chunk's Err
+// instead.
+type Backend interface {
+	Complete(ctx context.Context, msgs []Message, opts Options) (<-chan Chunk, error)
+}
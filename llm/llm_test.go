@@ -0,0 +1,97 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, chunks <-chan Chunk) string {
+	t.Helper()
+	var sb strings.Builder
+	for c := range chunks {
+		if c.Err != nil {
+			t.Fatalf("unexpected stream error: %v", c.Err)
+		}
+		sb.WriteString(c.Content)
+	}
+	return sb.String()
+}
+
+func TestOpenAIBackendStreamsChunks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("unexpected Authorization header: %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	b := NewOpenAI("test-key", srv.URL, "gpt-4o-mini")
+	chunks, err := b.Complete(context.Background(), []Message{{Role: "user", Content: "hi"}}, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := collect(t, chunks); got != "Hello" {
+		t.Fatalf("expected %q, got %q", "Hello", got)
+	}
+}
+
+func TestOpenAIBackendReportsHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	b := NewOpenAI("bad-key", srv.URL, "gpt-4o-mini")
+	if _, err := b.Complete(context.Background(), nil, Options{}); err == nil {
+		t.Fatalf("expected an error for a non-200 response")
+	}
+}
+
+func TestOllamaBackendStreamsChunks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"content":"Hel"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"content":"lo"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"content":""},"done":true}`)
+	}))
+	defer srv.Close()
+
+	b := NewOllama(srv.URL, "llama3")
+	chunks, err := b.Complete(context.Background(), []Message{{Role: "user", Content: "hi"}}, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := collect(t, chunks); got != "Hello" {
+		t.Fatalf("expected %q, got %q", "Hello", got)
+	}
+}
+
+func TestOllamaBackendReportsStreamError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"error":"model not found"}`)
+	}))
+	defer srv.Close()
+
+	b := NewOllama(srv.URL, "missing-model")
+	chunks, err := b.Complete(context.Background(), nil, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var gotErr bool
+	for c := range chunks {
+		if c.Err != nil {
+			gotErr = true
+		}
+	}
+	if !gotErr {
+		t.Fatalf("expected a stream-level error")
+	}
+}
@@ -0,0 +1,116 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OllamaBackend talks to a local Ollama server's /api/chat endpoint,
+// streaming the reply as newline-delimited JSON objects.
+type OllamaBackend struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+// NewOllama builds a Backend against an Ollama server at url (e.g.
+// "http://localhost:11434"), defaulting to model unless an Options.Model
+// override is given per call.
+func NewOllama(url, model string) *OllamaBackend {
+	return &OllamaBackend{
+		url:    strings.TrimRight(url, "/"),
+		model:  model,
+		client: http.DefaultClient,
+	}
+}
+
+type ollamaRequest struct {
+	Model    string         `json:"model"`
+	Messages []Message      `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  *ollamaOptions `json:"options,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature float64 `json:"temperature,omitempty"`
+}
+
+type ollamaStreamLine struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done  bool   `json:"done"`
+	Error string `json:"error"`
+}
+
+// Complete implements Backend.
+func (b *OllamaBackend) Complete(ctx context.Context, msgs []Message, opts Options) (<-chan Chunk, error) {
+	model := b.model
+	if opts.Model != "" {
+		model = opts.Model
+	}
+
+	reqBody := ollamaRequest{Model: model, Messages: msgs, Stream: true}
+	if opts.Temperature != 0 {
+		reqBody.Options = &ollamaOptions{Temperature: opts.Temperature}
+	}
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("llm: ollama request failed: %s", resp.Status)
+	}
+
+	out := make(chan Chunk)
+	go func() {
+		defer resp.Body.Close()
+		defer close(out)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			var parsed ollamaStreamLine
+			if err := json.Unmarshal(line, &parsed); err != nil {
+				out <- Chunk{Err: err}
+				return
+			}
+			if parsed.Error != "" {
+				out <- Chunk{Err: fmt.Errorf("llm: ollama error: %s", parsed.Error)}
+				return
+			}
+			if parsed.Message.Content != "" {
+				out <- Chunk{Content: parsed.Message.Content}
+			}
+			if parsed.Done {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			out <- Chunk{Err: err}
+		}
+	}()
+	return out, nil
+}
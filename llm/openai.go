@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OpenAIBackend talks to any OpenAI-compatible /chat/completions endpoint
+// (OpenAI itself, or a local server that mimics its API) over HTTP,
+// streaming the reply via server-sent events.
+type OpenAIBackend struct {
+	apiKey  string
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// NewOpenAI builds a Backend using apiKey against baseURL (e.g.
+// "https://api.openai.com/v1"), defaulting to model unless an Options.Model
+// override is given per call.
+func NewOpenAI(apiKey, baseURL, model string) *OpenAIBackend {
+	return &OpenAIBackend{
+		apiKey:  apiKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		model:   model,
+		client:  http.DefaultClient,
+	}
+}
+
+type openAIRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream"`
+	Temperature float64   `json:"temperature,omitempty"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// Complete implements Backend.
+func (b *OpenAIBackend) Complete(ctx context.Context, msgs []Message, opts Options) (<-chan Chunk, error) {
+	model := b.model
+	if opts.Model != "" {
+		model = opts.Model
+	}
+
+	body, err := json.Marshal(openAIRequest{Model: model, Messages: msgs, Stream: true, Temperature: opts.Temperature})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+b.apiKey)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("llm: openai request failed: %s", resp.Status)
+	}
+
+	out := make(chan Chunk)
+	go func() {
+		defer resp.Body.Close()
+		defer close(out)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if data == "[DONE]" {
+				return
+			}
+
+			var chunk openAIStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				out <- Chunk{Err: err}
+				return
+			}
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+			if content := chunk.Choices[0].Delta.Content; content != "" {
+				out <- Chunk{Content: content}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			out <- Chunk{Err: err}
+		}
+	}()
+	return out, nil
+}
@@ -1,228 +1,490 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/Lvntt/go-persistent-conversation-bot/flow"
+	"github.com/Lvntt/go-persistent-conversation-bot/history"
+	"github.com/Lvntt/go-persistent-conversation-bot/i18n"
+	"github.com/Lvntt/go-persistent-conversation-bot/llm"
+	"github.com/Lvntt/go-persistent-conversation-bot/middleware"
+	"github.com/Lvntt/go-persistent-conversation-bot/storage"
 )
 
-// Состояния диалога
+// Шаги диалога профиля.
 const (
-	StateChoosing     = "choosing"
-	StateTypingReply  = "typing_reply"
-	StateTypingChoice = "typing_choice"
+	stepChoosing     = "choosing"
+	stepTypingChoice = "typing_choice"
+	stepTypingReply  = "typing_reply"
+	stepDone         = "done"
 )
 
+// Режимы общения с ботом: modeStructured — прежний сценарный диалог
+// (зафиксирован как "", чтобы уже сохранённые пользователи без этого поля
+// остались в нём), modeChat — свободное общение через LLM-бэкенд.
+const (
+	modeStructured = ""
+	modeChat       = "chat"
+)
+
+// defaultChatHistoryLimit is how many ChatHistory messages are kept once
+// CHAT_HISTORY_LIMIT isn't set; see trimChatHistory.
+const defaultChatHistoryLimit = 40
+
+// chatEditInterval is how often a streaming chat reply's Telegram message
+// is updated via editMessageText while chunks keep arriving.
+const chatEditInterval = 500 * time.Millisecond
+
+// categoryIDs are the locale-independent ids of the fixed categories
+// offered on the keyboard. Facts are always keyed by these ids (or, for a
+// custom category, by the lowercased text the user typed), never by a
+// localized label, so switching a user's language never orphans data
+// they've already told the bot.
+var categoryIDs = []string{"age", "favourite_colour", "number_of_siblings"}
+
+// allButtonIDs is every button shown on the category keyboard, in display
+// order.
+var allButtonIDs = append(append([]string{}, categoryIDs...), "something_else", "done")
+
+// catalog holds every locale loaded from LOCALES_DIR (default "locales").
+var catalog *i18n.Catalog
+
+func init() {
+	dir := os.Getenv("LOCALES_DIR")
+	if dir == "" {
+		dir = "locales"
+	}
+	fallback := os.Getenv("DEFAULT_LANG")
+	if fallback == "" {
+		fallback = "en"
+	}
+	c, err := i18n.LoadDir(dir, fallback)
+	if err != nil {
+		log.Fatalf("failed to load locales from %s: %v", dir, err)
+	}
+	catalog = c
+}
+
 // UserState хранит состояние разговора с конкретным пользователем.
 type UserState struct {
-	State  string            `json:"state"`
-	Data   map[string]string `json:"data"`
-	Choice string            `json:"choice"`
+	State string `json:"state"`
+	// Choice хранится под полем PendingChoice, чтобы не конфликтовать с
+	// одноимённым методом flow.State ниже, но JSON-тег оставлен прежним
+	// ради совместимости с уже сохранёнными файлами.
+	PendingChoice string `json:"choice"`
+	// History хранит факты пользователя как дерево сообщений вместо плоской
+	// карты: правка категории создаёт соседний узел, а не перезаписывает
+	// старое значение, так что прежние ответы остаются доступны через
+	// /history и /switch.
+	History *history.Tree `json:"history"`
+	// Language хранится под полем Language по той же причине, что и
+	// PendingChoice: имя конфликтовало бы с методом Lang() ниже.
+	Language string `json:"lang"`
+	// Mode selects between the scripted profile flow (modeStructured) and
+	// free-form LLM chat (modeChat), toggled by /chat and /structured.
+	Mode string `json:"mode"`
+	// ChatHistory is the free-form chat mode's message log, capped by
+	// trimChatHistory. It is independent of History: /forget clears it
+	// without touching anything the user has told the scripted flow.
+	ChatHistory []llm.Message `json:"chat_history"`
 }
 
 // NewUserState создаёт пустое состояние пользователя.
 func NewUserState() *UserState {
 	return &UserState{
-		State: StateChoosing,
-		Data:  make(map[string]string),
+		History: history.NewTree(),
+	}
+}
+
+// Ниже — реализация flow.State поверх UserState, которая и подключает
+// диалог профиля к декларативному flow.Flow.
+
+func (u *UserState) CurrentStep() string { return u.State }
+func (u *UserState) SetStep(name string) { u.State = name }
+
+// Facts derives the current facts from History: the latest value per
+// category along the head->root path, exactly as factsToStr and friends
+// have always seen them.
+func (u *UserState) Facts() map[string]string { return u.History.Facts() }
+
+func (u *UserState) Fact(key string) (string, bool) { return u.History.Fact(key) }
+
+func (u *UserState) SetFact(key, value string) { u.History.Append("user", key, value) }
+
+func (u *UserState) Choice() string     { return u.PendingChoice }
+func (u *UserState) SetChoice(c string) { u.PendingChoice = c }
+
+func (u *UserState) Lang() string { return u.Language }
+
+// displayCategory renders a fact's key for display in l's language: fixed
+// category ids render as their localized button label, lowercased (to
+// match the historical "age - 30" style); a custom category's key is the
+// text the user typed for it, so it's rendered verbatim.
+func displayCategory(id string, l *i18n.Localizer) string {
+	for _, cid := range categoryIDs {
+		if cid == id {
+			return strings.ToLower(l.Button(id))
+		}
 	}
+	return id
 }
 
 // factsToStr форматирует сохранённые факты, как в Python-версии.
-func factsToStr(data map[string]string) string {
+func factsToStr(data map[string]string, l *i18n.Localizer) string {
 	if len(data) == 0 {
 		return "\n\n"
 	}
 	var parts []string
 	for k, v := range data {
-		parts = append(parts, fmt.Sprintf("%s - %s", k, v))
+		parts = append(parts, fmt.Sprintf("%s - %s", displayCategory(k, l), v))
 	}
 	return "\n" + strings.Join(parts, "\n") + "\n"
 }
 
-// HandleCommandStart реализует поведение /start.
-func (u *UserState) HandleCommandStart() string {
-	var sb strings.Builder
-	sb.WriteString("Hi! My name is Doctor Botter.")
-	if len(u.Data) > 0 {
-		// Ключи уже хранятся в нижнем регистре, как в Python-коде
-		var keys []string
-		for k := range u.Data {
-			keys = append(keys, k)
-		}
-		sb.WriteString(" You already told me your ")
-		sb.WriteString(strings.Join(keys, ", "))
-		sb.WriteString(". Why don't you tell me something more about yourself? Or change anything I already know.")
-	} else {
-		sb.WriteString(" I will hold a more complex conversation with you. Why don't you tell me something about yourself?")
+// startMessage формирует приветствие /start в зависимости от уже известных фактов.
+func startMessage(l *i18n.Localizer, data map[string]string) string {
+	if len(data) == 0 {
+		return l.T("start.newcomer", nil)
+	}
+	var keys []string
+	for k := range data {
+		keys = append(keys, displayCategory(k, l))
 	}
-	u.State = StateChoosing
-	return sb.String()
+	return l.T("start.returning", struct{ Keys string }{strings.Join(keys, ", ")})
 }
 
-// HandleShowData реализует /show_data.
-func (u *UserState) HandleShowData() string {
-	return "This is what you already told me: " + factsToStr(u.Data)
+// showDataMessage формирует ответ на /show_data.
+func showDataMessage(l *i18n.Localizer, data map[string]string) string {
+	return l.T("show_data.intro", struct{ Facts string }{factsToStr(data, l)})
 }
 
-// HandleText обрабатывает обычный текст (не команды).
-// Возвращает текст ответа, нужно ли показать клавиатуру и завершён ли диалог (“Done”).
-func (u *UserState) HandleText(text string) (reply string, withKeyboard bool, done bool) {
-	// Фраза "Done" работает из любого состояния.
-	if text == "Done" {
-		u.Choice = ""
-		reply = "I learned these facts about you: " + factsToStr(u.Data) + "Until next time!"
-		u.State = ""
-		return reply, false, true
+// addMainKeyboard добавляет в reply кнопки категорий на языке l.
+func addMainKeyboard(r *flow.Reply, l *i18n.Localizer) {
+	for _, id := range allButtonIDs {
+		r.AddButton(l.Button(id))
 	}
+	r.ShowKeyboard()
+}
 
-	switch u.State {
-	case StateChoosing:
-		return u.handleChoosing(text)
-	case StateTypingChoice:
-		return u.handleTypingChoice(text)
-	case StateTypingReply:
-		return u.handleTypingReply(text)
-	default:
-		// Если по какой-то причине нет состояния — считаем, что снова выбираем.
-		u.State = StateChoosing
-		return u.handleChoosing(text)
-	}
+// doneReply завершает диалог и возвращает имя терминального шага.
+func doneReply(r *flow.Reply, s flow.State, l *i18n.Localizer) string {
+	r.Message(l.T("done.message", struct{ Facts string }{factsToStr(s.Facts(), l)}))
+	s.SetChoice("")
+	return stepDone
 }
 
-func (u *UserState) handleChoosing(text string) (string, bool, bool) {
-	switch text {
-	case "Age", "Favourite colour", "Number of siblings":
-		choice := strings.ToLower(text)
-		u.Choice = choice
-		if existing, ok := u.Data[choice]; ok {
-			return fmt.Sprintf("Your %s? I already know the following about that: %s", choice, existing), false, false
-		}
-		u.State = StateTypingReply
-		return fmt.Sprintf("Your %s? Yes, I would love to hear about that!", choice), false, false
+func chooseCategory(r *flow.Reply, text string, s flow.State) (string, error) {
+	l := catalog.Localizer(s.Lang())
+
+	id, ok := l.ButtonID(text, allButtonIDs)
+	if !ok {
+		r.Message(l.T("prompt.choose_category", nil))
+		addMainKeyboard(r, l)
+		return stepChoosing, nil
+	}
 
-	case "Something else...":
-		u.State = StateTypingChoice
-		return "Alright, please send me the category first, for example \"Most impressive skill\"", false, false
+	switch id {
+	case "done":
+		return doneReply(r, s, l), nil
+	case "something_else":
+		r.Message(l.T("prompt.custom_category", nil))
+		return stepTypingChoice, nil
+	}
 
-	default:
-		// В оригинале такого случая нет – добавим мягкое напоминание.
-		return "Please choose one of the options on the keyboard or type \"Done\".", true, false
+	s.SetChoice(id)
+	category := displayCategory(id, l)
+	if existing, ok := s.Fact(id); ok {
+		r.Message(l.T("prompt.category_known", struct{ Category, Existing string }{category, existing}))
+		return stepChoosing, nil
 	}
+	r.Message(l.T("prompt.category_new", struct{ Category string }{category}))
+	return stepTypingReply, nil
 }
 
-func (u *UserState) handleTypingChoice(text string) (string, bool, bool) {
-	// Пользователь прислал название категории (кастомный вариант)
+func typeCustomChoice(r *flow.Reply, text string, s flow.State) (string, error) {
+	l := catalog.Localizer(s.Lang())
+	if id, ok := l.ButtonID(text, []string{"done"}); ok && id == "done" {
+		return doneReply(r, s, l), nil
+	}
+
 	choice := strings.ToLower(text)
-	u.Choice = choice
-	if existing, ok := u.Data[choice]; ok {
-		u.State = StateTypingReply
-		return fmt.Sprintf("Your %s? I already know the following about that: %s", choice, existing), false, false
+	s.SetChoice(choice)
+	if existing, ok := s.Fact(choice); ok {
+		r.Message(l.T("prompt.category_known", struct{ Category, Existing string }{choice, existing}))
+	} else {
+		r.Message(l.T("prompt.category_new", struct{ Category string }{choice}))
 	}
-	u.State = StateTypingReply
-	return fmt.Sprintf("Your %s? Yes, I would love to hear about that!", choice), false, false
+	return stepTypingReply, nil
 }
 
-func (u *UserState) handleTypingReply(text string) (string, bool, bool) {
-	if u.Choice == "" {
+func saveValue(r *flow.Reply, text string, s flow.State) (string, error) {
+	l := catalog.Localizer(s.Lang())
+	if id, ok := l.ButtonID(text, []string{"done"}); ok && id == "done" {
+		return doneReply(r, s, l), nil
+	}
+
+	choice := s.Choice()
+	if choice == "" {
 		// На всякий случай – если вдруг что-то сломалось.
-		u.State = StateChoosing
-		return "I am not sure what category this belongs to. Please choose one of the options.", true, false
+		r.Message(l.T("prompt.choice_missing", nil))
+		addMainKeyboard(r, l)
+		return stepChoosing, nil
 	}
-	category := u.Choice
-	value := strings.ToLower(text)
-	u.Data[category] = value
-	u.Choice = ""
-	u.State = StateChoosing
 
-	reply := "Neat! Just so you know, this is what you already told me:" +
-		factsToStr(u.Data) +
-		"You can tell me more, or change your opinion on something."
-	return reply, true, false
+	s.SetFact(choice, strings.ToLower(text))
+	s.SetChoice("")
+	r.Message(l.T("prompt.saved", struct{ Facts string }{factsToStr(s.Facts(), l)}))
+	addMainKeyboard(r, l)
+	return stepChoosing, nil
 }
 
-// ---------- Хранилище (файловая "БД") ----------
-
-type Storage struct {
-	path string
-	mu   sync.Mutex
+// historyLine renders one message as one line of /history output.
+func historyLine(m history.Message, l *i18n.Localizer) string {
+	return l.T("history.entry", struct{ Hash, Category, Text string }{
+		m.Hash(), displayCategory(m.Category, l), m.Text,
+	})
 }
 
-type persistedData struct {
-	Users map[int64]*UserState `json:"users"`
+// handleHistory renders the current head->root path, oldest first, each
+// line prefixed by the short hash /edit and /switch take as an argument.
+func handleHistory(s flow.State, _ string) flow.Reply {
+	u := s.(*UserState)
+	l := catalog.Localizer(s.Lang())
+
+	path := u.History.Path()
+	if len(path) == 0 {
+		return *flow.NewReply().Message(l.T("history.empty", nil))
+	}
+	lines := make([]string, len(path))
+	for i, m := range path {
+		lines[i] = historyLine(m, l)
+	}
+	return *flow.NewReply().Message(strings.Join(lines, "\n"))
 }
 
-func NewStorage(path string) *Storage {
-	return &Storage{path: path}
+// handleEdit implements "/edit <hash> <new text>": it replaces the message
+// identified by hash with a sibling holding the new text and moves the
+// head there, preserving (but abandoning) anything built on top of the
+// original.
+func handleEdit(s flow.State, args string) flow.Reply {
+	u := s.(*UserState)
+	l := catalog.Localizer(s.Lang())
+
+	hash, text, ok := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+	if !ok || hash == "" || text == "" {
+		return *flow.NewReply().Message(l.T("edit.usage", nil))
+	}
+	if _, err := u.History.Edit(hash, strings.ToLower(text)); err != nil {
+		return *flow.NewReply().Message(l.T("edit.not_found", struct{ Hash string }{hash}))
+	}
+	return *flow.NewReply().Message(l.T("edit.done", nil))
 }
 
-func (s *Storage) Load() (map[int64]*UserState, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// handleSwitch implements "/switch <hash>": it moves the head to an
+// existing message without creating a new one, e.g. to undo the last edit.
+func handleSwitch(s flow.State, args string) flow.Reply {
+	u := s.(*UserState)
+	l := catalog.Localizer(s.Lang())
 
-	data := persistedData{
-		Users: make(map[int64]*UserState),
+	hash := strings.TrimSpace(args)
+	if hash == "" {
+		return *flow.NewReply().Message(l.T("switch.usage", nil))
+	}
+	if err := u.History.Switch(hash); err != nil {
+		return *flow.NewReply().Message(l.T("switch.not_found", struct{ Hash string }{hash}))
 	}
+	return *flow.NewReply().Message(l.T("switch.done", nil))
+}
 
-	b, err := os.ReadFile(s.path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return data.Users, nil
+// chatHistoryLimit is how many ChatHistory messages trimChatHistory keeps,
+// read from CHAT_HISTORY_LIMIT so operators can tune it without a rebuild.
+func chatHistoryLimit() int {
+	if v := os.Getenv("CHAT_HISTORY_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
 		}
-		return nil, err
 	}
-	if err := json.Unmarshal(b, &data); err != nil {
-		return nil, err
+	return defaultChatHistoryLimit
+}
+
+// trimChatHistory drops the oldest ChatHistory messages once the window
+// configured by chatHistoryLimit is exceeded.
+func trimChatHistory(u *UserState) {
+	limit := chatHistoryLimit()
+	if len(u.ChatHistory) > limit {
+		u.ChatHistory = u.ChatHistory[len(u.ChatHistory)-limit:]
 	}
-	if data.Users == nil {
-		data.Users = make(map[int64]*UserState)
+}
+
+// systemPreamble builds the system message chat mode opens every completion
+// with, so the LLM backend sees what the user already told the scripted
+// flow ("The user previously told you: age - 30, favourite colour - blue").
+func systemPreamble(u *UserState, l *i18n.Localizer) llm.Message {
+	facts := u.Facts()
+	if len(facts) == 0 {
+		return llm.Message{Role: "system", Content: l.T("chat.system_prompt", nil)}
 	}
-	return data.Users, nil
+	parts := make([]string, 0, len(facts))
+	for k, v := range facts {
+		parts = append(parts, fmt.Sprintf("%s - %s", displayCategory(k, l), v))
+	}
+	sort.Strings(parts)
+	return llm.Message{Role: "system", Content: l.T("chat.system_prompt_known", struct{ Facts string }{strings.Join(parts, ", ")})}
 }
 
-func (s *Storage) Save(users map[int64]*UserState) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// newProfileFlow объявляет диалог профиля декларативно, вместо ручного
+// switch по состояниям. Подсказки и кнопки локализуются обработчиками
+// шагов по языку конкретного пользователя, поэтому сами шаги объявлены
+// без статического текста и кнопок.
+func newProfileFlow() *flow.Flow {
+	return flow.New("profile").
+		Command("start", func(s flow.State, _ string) flow.Reply {
+			s.SetStep(stepChoosing)
+			s.SetChoice("")
+			l := catalog.Localizer(s.Lang())
+			r := flow.NewReply().Message(startMessage(l, s.Facts()))
+			addMainKeyboard(r, l)
+			return *r
+		}).
+		Command("show_data", func(s flow.State, _ string) flow.Reply {
+			l := catalog.Localizer(s.Lang())
+			return *flow.NewReply().Message(showDataMessage(l, s.Facts()))
+		}).
+		Command("history", handleHistory).
+		Command("edit", handleEdit).
+		Command("switch", handleSwitch).
+		Command("chat", func(s flow.State, _ string) flow.Reply {
+			u := s.(*UserState)
+			u.Mode = modeChat
+			l := catalog.Localizer(s.Lang())
+			return *flow.NewReply().Message(l.T("chat.entered", nil))
+		}).
+		Command("structured", func(s flow.State, _ string) flow.Reply {
+			u := s.(*UserState)
+			u.Mode = modeStructured
+			l := catalog.Localizer(s.Lang())
+			return *flow.NewReply().Message(l.T("chat.exited", nil))
+		}).
+		Command("forget", func(s flow.State, _ string) flow.Reply {
+			u := s.(*UserState)
+			u.ChatHistory = nil
+			l := catalog.Localizer(s.Lang())
+			return *flow.NewReply().Message(l.T("chat.forgotten", nil))
+		}).
+		Prompt(stepChoosing, "").
+		Next(chooseCategory).
+		Prompt(stepTypingChoice, "").
+		Next(typeCustomChoice).
+		Prompt(stepTypingReply, "").
+		Next(saveValue).
+		End(stepDone, "")
+}
 
-	data := persistedData{Users: users}
-	b, err := json.MarshalIndent(&data, "", "  ")
-	if err != nil {
-		return err
+// ---------- Хранилище ----------
+
+// toRecord переводит UserState в формат, который понимает storage.Storage.
+func toRecord(u *UserState) *storage.Record {
+	return &storage.Record{
+		State:       u.State,
+		Choice:      u.PendingChoice,
+		History:     u.History,
+		Lang:        u.Language,
+		Mode:        u.Mode,
+		ChatHistory: u.ChatHistory,
+	}
+}
+
+// fromRecord восстанавливает UserState из storage.Record, перенося
+// пользователей, сохранённых до появления History, на дерево сообщений:
+// каждая запись старой плоской карты data[k]=v становится одним
+// сообщением (см. history.FromFlatMap).
+func fromRecord(rec *storage.Record) *UserState {
+	tree := rec.History
+	if tree == nil || len(tree.Messages) == 0 {
+		if len(rec.Data) > 0 {
+			tree = history.FromFlatMap(rec.Data)
+		} else {
+			tree = history.NewTree()
+		}
 	}
-	tmpPath := s.path + ".tmp"
-	if err := os.WriteFile(tmpPath, b, 0o644); err != nil {
-		return err
+	return &UserState{
+		State:         rec.State,
+		PendingChoice: rec.Choice,
+		History:       tree,
+		Language:      rec.Lang,
+		Mode:          rec.Mode,
+		ChatHistory:   rec.ChatHistory,
 	}
-	return os.Rename(tmpPath, s.path)
 }
 
 // ---------- Обёртка бота ----------
 
 type Bot struct {
 	api     *tgbotapi.BotAPI
-	storage *Storage
+	storage storage.Storage
+	flow    *flow.Flow
+	llm     llm.Backend
+
+	mu        sync.Mutex
+	users     map[int64]*UserState
+	userLocks map[int64]*sync.Mutex
+
+	middlewares []middleware.Middleware
+	chain       middleware.Handler
 
-	mu    sync.Mutex
-	users map[int64]*UserState
+	subsMu sync.Mutex
+	subs   []*Subscription
 }
 
-func NewBot(api *tgbotapi.BotAPI, storage *Storage) (*Bot, error) {
-	users, err := storage.Load()
+func NewBot(api *tgbotapi.BotAPI, store storage.Storage) (*Bot, error) {
+	records, err := store.Load()
 	if err != nil {
 		return nil, err
 	}
-	return &Bot{
+	users := make(map[int64]*UserState, len(records))
+	for id, rec := range records {
+		users[id] = fromRecord(rec)
+	}
+	b := &Bot{
 		api:     api,
-		storage: storage,
+		storage: store,
+		flow:    newProfileFlow(),
 		users:   users,
-	}, nil
+	}
+	b.chain = b.buildChain()
+	return b, nil
+}
+
+// SetLLMBackend configures the backend chat mode forwards free-form
+// messages to. Until it's called, messages sent in chat mode are answered
+// with chat.unavailable instead of being dispatched anywhere.
+func (b *Bot) SetLLMBackend(backend llm.Backend) {
+	b.llm = backend
+}
+
+// Use registers middlewares, in the order they should see an update, and
+// rebuilds the handler chain. It is meant to be called during setup,
+// before Run starts processing updates — the chain is built once here,
+// not on every incoming message.
+func (b *Bot) Use(mw ...middleware.Middleware) {
+	b.middlewares = append(b.middlewares, mw...)
+	b.chain = b.buildChain()
+}
+
+func (b *Bot) buildChain() middleware.Handler {
+	return middleware.Chain(b.handleUpdate, b.middlewares...)
 }
 
 func (b *Bot) getUserState(userID int64) *UserState {
@@ -240,98 +502,345 @@ func (b *Bot) getUserState(userID int64) *UserState {
 	return us
 }
 
-func mainKeyboard() tgbotapi.ReplyKeyboardMarkup {
-	kb := tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton("Age"),
-			tgbotapi.NewKeyboardButton("Favourite colour"),
-		),
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton("Number of siblings"),
-			tgbotapi.NewKeyboardButton("Something else..."),
-		),
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton("Done"),
-		),
-	)
+// userLock returns the mutex serializing updates for a single user, so a
+// slow chat-mode completion for one message doesn't race the next message
+// from the same user. Different users never share a lock, so they're
+// processed fully in parallel — see handleMessage.
+func (b *Bot) userLock(userID int64) *sync.Mutex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.userLocks == nil {
+		b.userLocks = make(map[int64]*sync.Mutex)
+	}
+	l, ok := b.userLocks[userID]
+	if !ok {
+		l = &sync.Mutex{}
+		b.userLocks[userID] = l
+	}
+	return l
+}
+
+// buildKeyboard строит клавиатуру Telegram из списка подписей кнопок,
+// размещая их по две в ряд, как и раньше.
+func buildKeyboard(buttons []string) tgbotapi.ReplyKeyboardMarkup {
+	var rows [][]tgbotapi.KeyboardButton
+	for i := 0; i < len(buttons); i += 2 {
+		end := i + 2
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		var row []tgbotapi.KeyboardButton
+		for _, label := range buttons[i:end] {
+			row = append(row, tgbotapi.NewKeyboardButton(label))
+		}
+		rows = append(rows, row)
+	}
+	kb := tgbotapi.NewReplyKeyboard(rows...)
 	kb.OneTimeKeyboard = true
 	return kb
 }
 
-func (b *Bot) save() {
+// saveUser persists only the given user's state, instead of the whole map.
+func (b *Bot) saveUser(userID int64) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	if err := b.storage.Save(b.users); err != nil {
-		log.Printf("error saving state: %v", err)
+	us := b.users[userID]
+	b.mu.Unlock()
+	if us == nil {
+		return
+	}
+	if err := b.storage.SaveUser(userID, toRecord(us)); err != nil {
+		log.Printf("error saving state for user %d: %v", userID, err)
 	}
 }
 
+// Run polls Telegram for updates and dispatches each to handleMessage on
+// its own goroutine, so a slow chat-mode completion (handleChat can block
+// on an LLM stream for tens of seconds) for one user never delays another
+// user's /start. Updates from the same user still run one at a time, in
+// arrival order: each waits for that user's previous update to finish.
 func (b *Bot) Run() error {
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
 	updates := b.api.GetUpdatesChan(u)
+	// prev holds, per sender, a channel closed once that sender's latest
+	// dispatched update has been handled.
+	prev := make(map[int64]chan struct{})
 	for update := range updates {
-		if update.Message == nil {
+		msg := update.Message
+		if msg == nil {
 			continue
 		}
-		b.handleMessage(update.Message)
+		var sender int64
+		if msg.From != nil {
+			sender = msg.From.ID
+		}
+		wait, done := prev[sender], make(chan struct{})
+		prev[sender] = done
+		go func() {
+			defer close(done)
+			if wait != nil {
+				<-wait
+			}
+			b.handleMessage(msg)
+		}()
 	}
 	return nil
 }
 
+// handleMessage turns a Telegram message into a middleware.Context and
+// runs it through the chain built by Use. It holds this user's lock for
+// the duration, so concurrent messages from the same user (see Run) are
+// serialized instead of racing on their shared UserState.
 func (b *Bot) handleMessage(msg *tgbotapi.Message) {
 	if msg.From == nil {
+		// Previously a silent return; logged now so a sender-less update
+		// (e.g. a channel post) leaves a visible trace instead of vanishing.
+		log.Printf("dropping update in chat %d: no sender", msg.Chat.ID)
 		return
 	}
+
 	userID := msg.From.ID
 	chatID := msg.Chat.ID
-	text := msg.Text
+
+	lock := b.userLock(userID)
+	lock.Lock()
+	defer lock.Unlock()
 
 	userState := b.getUserState(userID)
+	if userState.Language == "" && msg.From.LanguageCode != "" {
+		userState.Language = msg.From.LanguageCode
+	}
+
+	ctx := middleware.NewContext(
+		userID, chatID, msg.Text, msg.IsCommand(), msg.Command(), msg.CommandArguments(), userState,
+		func(text string, opts ...middleware.ReplyOpt) { b.send(chatID, text, opts...) },
+		func() { b.saveUser(userID) },
+	)
+
+	if err := b.chain(ctx); err != nil {
+		log.Printf("handler error for user %d: %v", userID, err)
+		b.publishError(fmt.Errorf("handler error for user %d: %w", userID, err))
+	}
+}
 
-	var reply string
-	var withKeyboard bool
-	var done bool
-	var removeKeyboard bool
-
-	if msg.IsCommand() {
-		switch msg.Command() {
-		case "start":
-			reply = userState.HandleCommandStart()
-			withKeyboard = true
-		case "show_data":
-			reply = userState.HandleShowData()
-		default:
-			reply = "Unknown command."
+// handleUpdate is the base Handler: it runs the profile flow and replies.
+// It knows nothing about logging, auth, or rate limiting — those are
+// layered on top of it as middleware via Use.
+func (b *Bot) handleUpdate(ctx *middleware.Context) error {
+	state := ctx.UserState()
+	u := state.(*UserState)
+
+	b.publishMessage(MessageEvent{UserID: ctx.UserID(), ChatID: ctx.ChatID(), Text: ctx.Text()})
+	if ctx.IsCommand() {
+		b.publishCommand(CommandEvent{UserID: ctx.UserID(), ChatID: ctx.ChatID(), Command: ctx.Command(), Args: ctx.CommandArgs()})
+	}
+
+	if !ctx.IsCommand() && u.Mode == modeChat {
+		if ctx.Text() == "" {
+			return nil
+		}
+		return b.handleChat(ctx, u)
+	}
+
+	before := state.CurrentStep()
+
+	var reply flow.Reply
+	if ctx.IsCommand() {
+		var ok bool
+		reply, ok = b.flow.RunCommand(ctx.Command(), ctx.CommandArgs(), state)
+		if !ok {
+			reply = *flow.NewReply().Message(catalog.Localizer(state.Lang()).T("unknown_command", nil))
 		}
 	} else {
-		if text == "" {
-			return
+		if ctx.Text() == "" {
+			return nil
 		}
-		reply, withKeyboard, done = userState.HandleText(text)
-		if done {
-			removeKeyboard = true
+		var err error
+		reply, err = b.flow.Step(state, ctx.Text())
+		if err != nil {
+			return err
 		}
 	}
 
+	if after := state.CurrentStep(); after != before {
+		b.publishStateTransition(StateTransitionEvent{UserID: ctx.UserID(), ChatID: ctx.ChatID(), From: before, To: after})
+	}
+
+	if reply.Text() == "" {
+		return nil
+	}
+
+	switch {
+	case reply.Done():
+		ctx.Reply(reply.Text(), middleware.WithKeyboardRemoved())
+	case reply.WithKeyboard():
+		ctx.Reply(reply.Text(), middleware.WithKeyboard(reply.Buttons()...))
+	default:
+		ctx.Reply(reply.Text())
+	}
+	ctx.Save()
+	return nil
+}
+
+// handleChat forwards a free-form message to the configured llm.Backend and
+// streams the reply back as a single Telegram message, edited in place as
+// chunks arrive. It bypasses b.flow entirely: streaming needs the live
+// Telegram message id to edit, which the synchronous flow.Reply model has
+// no room for.
+func (b *Bot) handleChat(ctx *middleware.Context, u *UserState) error {
+	l := catalog.Localizer(u.Lang())
+
+	if b.llm == nil {
+		ctx.Reply(l.T("chat.unavailable", nil))
+		return nil
+	}
+
+	u.ChatHistory = append(u.ChatHistory, llm.Message{Role: "user", Content: ctx.Text()})
+	trimChatHistory(u)
+
+	msgs := append([]llm.Message{systemPreamble(u, l)}, u.ChatHistory...)
+	chunks, err := b.llm.Complete(context.Background(), msgs, llm.Options{})
+	if err != nil {
+		log.Printf("llm completion error for user %d: %v", ctx.UserID(), err)
+		ctx.Reply(l.T("chat.error", nil))
+		return nil
+	}
+
+	reply, streamErr := b.streamReply(ctx.ChatID(), chunks)
 	if reply == "" {
-		return
+		// Either the stream failed before any content arrived, or the
+		// backend sent nothing at all; either way there's no partial
+		// message on screen to speak for itself, so tell the user
+		// explicitly instead of leaving them hanging.
+		log.Printf("llm stream produced no content for user %d: %v", ctx.UserID(), streamErr)
+		ctx.Reply(l.T("chat.error", nil))
+		return nil
+	}
+
+	u.ChatHistory = append(u.ChatHistory, llm.Message{Role: "assistant", Content: reply})
+	trimChatHistory(u)
+	ctx.Save()
+	return nil
+}
+
+// streamReply sends chunks as they arrive in a single Telegram message,
+// re-sent via editMessageText roughly every chatEditInterval so the user
+// sees the reply stream in. It returns the full accumulated text, and the
+// stream's error if it failed partway through.
+func (b *Bot) streamReply(chatID int64, chunks <-chan llm.Chunk) (string, error) {
+	var (
+		full      strings.Builder
+		msgID     int
+		lastEdit  time.Time
+		streamErr error
+	)
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			streamErr = chunk.Err
+			log.Printf("llm stream error: %v", chunk.Err)
+			break
+		}
+		full.WriteString(chunk.Content)
+
+		if msgID == 0 {
+			sent, err := b.api.Send(tgbotapi.NewMessage(chatID, full.String()))
+			if err != nil {
+				log.Printf("send error: %v", err)
+				continue
+			}
+			msgID = sent.MessageID
+			lastEdit = time.Now()
+			continue
+		}
+		if time.Since(lastEdit) < chatEditInterval {
+			continue
+		}
+		if _, err := b.api.Send(tgbotapi.NewEditMessageText(chatID, msgID, full.String())); err != nil {
+			log.Printf("edit error: %v", err)
+		}
+		lastEdit = time.Now()
 	}
 
-	out := tgbotapi.NewMessage(chatID, reply)
-	if removeKeyboard {
+	if msgID != 0 {
+		if _, err := b.api.Send(tgbotapi.NewEditMessageText(chatID, msgID, full.String())); err != nil {
+			log.Printf("edit error: %v", err)
+		}
+	}
+	return full.String(), streamErr
+}
+
+// send renders a middleware.Reply as an actual Telegram message.
+func (b *Bot) send(chatID int64, text string, opts ...middleware.ReplyOpt) {
+	var options middleware.ReplyOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	out := tgbotapi.NewMessage(chatID, text)
+	switch {
+	case options.RemoveKeyboard:
 		out.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-	} else if withKeyboard {
-		kb := mainKeyboard()
-		out.ReplyMarkup = kb
+	case len(options.Keyboard) > 0:
+		out.ReplyMarkup = buildKeyboard(options.Keyboard)
 	}
 
 	if _, err := b.api.Send(out); err != nil {
 		log.Printf("send error: %v", err)
 	}
+}
 
-	b.save()
+// newStorage builds the Storage backend selected by STORAGE_BACKEND
+// ("json", the default, or "sqlite"), wrapped in a write queue that
+// coalesces bursts of writes for the same user.
+func newStorage(dataDir, backend string) (storage.Storage, error) {
+	var (
+		base storage.Storage
+		err  error
+	)
+	switch backend {
+	case "", "json":
+		base = storage.NewJSONStorage(filepath.Join(dataDir, "conversationbot.json"))
+	case "sqlite":
+		base, err = storage.NewSQLiteStorage(filepath.Join(dataDir, "conversationbot.db"))
+		if err != nil {
+			return nil, fmt.Errorf("open sqlite storage: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q (expected json or sqlite)", backend)
+	}
+	return storage.NewWriteQueue(base), nil
+}
+
+// newLLMBackend builds the chat mode backend selected by LLM_BACKEND
+// ("openai" or "ollama"), or nil if it's unset — in which case messages
+// sent in chat mode are answered with chat.unavailable.
+func newLLMBackend() llm.Backend {
+	switch os.Getenv("LLM_BACKEND") {
+	case "openai":
+		baseURL := os.Getenv("OPENAI_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		model := os.Getenv("OPENAI_MODEL")
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		return llm.NewOpenAI(os.Getenv("OPENAI_API_KEY"), baseURL, model)
+	case "ollama":
+		url := os.Getenv("OLLAMA_URL")
+		if url == "" {
+			url = "http://localhost:11434"
+		}
+		model := os.Getenv("OLLAMA_MODEL")
+		if model == "" {
+			model = "llama3"
+		}
+		return llm.NewOllama(url, model)
+	default:
+		return nil
+	}
 }
 
 func main() {
@@ -347,9 +856,12 @@ func main() {
 	if err := os.MkdirAll(dataDir, 0o755); err != nil {
 		log.Fatalf("cannot create data dir %s: %v", dataDir, err)
 	}
-	dataPath := filepath.Join(dataDir, "conversationbot.json")
 
-	storage := NewStorage(dataPath)
+	store, err := newStorage(dataDir, os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	defer store.Close()
 
 	botAPI, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
@@ -359,12 +871,16 @@ func main() {
 
 	log.Printf("Authorized on account %s", botAPI.Self.UserName)
 
-	bot, err := NewBot(botAPI, storage)
+	bot, err := NewBot(botAPI, store)
 	if err != nil {
 		log.Fatalf("failed to create bot: %v", err)
 	}
+	bot.Use(middleware.Recover(), middleware.Log(log.Default()))
+	if backend := newLLMBackend(); backend != nil {
+		bot.SetLLMBackend(backend)
+	}
 
 	if err := bot.Run(); err != nil {
 		log.Fatalf("bot stopped with error: %v", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Recover catches panics raised by the rest of the chain, logs them, and
+// lets the bot keep running instead of taking the whole process down.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("middleware: recovered from panic handling user %d: %v", ctx.UserID(), r)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// Log writes one line per update through logger, including how long the
+// rest of the chain took and whether it returned an error.
+func Log(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *Context) error {
+			start := time.Now()
+			err := next(ctx)
+			logger.Printf("user=%d chat=%d text=%q took=%s err=%v",
+				ctx.UserID(), ctx.ChatID(), ctx.Text(), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Allowlist only lets updates from the given user IDs reach the rest of
+// the chain; everything else is dropped.
+func Allowlist(ids ...int64) Middleware {
+	allowed := toSet(ids)
+	return func(next Handler) Handler {
+		return func(ctx *Context) error {
+			if !allowed[ctx.UserID()] {
+				log.Printf("middleware: denied user %d (not in allowlist)", ctx.UserID())
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// Denylist drops updates from the given user IDs before they reach the
+// rest of the chain.
+func Denylist(ids ...int64) Middleware {
+	denied := toSet(ids)
+	return func(next Handler) Handler {
+		return func(ctx *Context) error {
+			if denied[ctx.UserID()] {
+				log.Printf("middleware: denied user %d (in denylist)", ctx.UserID())
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func toSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// bucket is a fixed-window per-user token bucket: it holds n tokens,
+// refilled to n every per.
+type bucket struct {
+	mu        sync.Mutex
+	remaining int
+	resetAt   time.Time
+}
+
+// RateLimit allows at most n updates per user in every window of length
+// per; updates beyond that are dropped without a reply, and each drop is
+// logged.
+func RateLimit(n int, per time.Duration) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[int64]*bucket)
+
+	return func(next Handler) Handler {
+		return func(ctx *Context) error {
+			mu.Lock()
+			b, ok := buckets[ctx.UserID()]
+			if !ok {
+				b = &bucket{remaining: n, resetAt: time.Now().Add(per)}
+				buckets[ctx.UserID()] = b
+			}
+			mu.Unlock()
+
+			b.mu.Lock()
+			if time.Now().After(b.resetAt) {
+				b.remaining = n
+				b.resetAt = time.Now().Add(per)
+			}
+			if b.remaining <= 0 {
+				b.mu.Unlock()
+				log.Printf("middleware: rate limited user %d", ctx.UserID())
+				return nil
+			}
+			b.remaining--
+			b.mu.Unlock()
+
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package middleware provides a telebot-style middleware chain for Bot:
+// a Handler processes one update, and a Middleware wraps a Handler with
+// cross-cutting behaviour (logging, auth, rate limiting, panic recovery)
+// without the handler itself knowing about it.
+package middleware
+
+import "github.com/Lvntt/go-persistent-conversation-bot/flow"
+
+// ReplyOptions controls how a Context.Reply call renders its keyboard.
+type ReplyOptions struct {
+	Keyboard       []string
+	RemoveKeyboard bool
+}
+
+// ReplyOpt configures a ReplyOptions.
+type ReplyOpt func(*ReplyOptions)
+
+// WithKeyboard shows the given buttons alongside the reply.
+func WithKeyboard(buttons ...string) ReplyOpt {
+	return func(o *ReplyOptions) { o.Keyboard = buttons }
+}
+
+// WithKeyboardRemoved hides the keyboard after the reply is shown.
+func WithKeyboardRemoved() ReplyOpt {
+	return func(o *ReplyOptions) { o.RemoveKeyboard = true }
+}
+
+// Context is the per-update context threaded through a Bot's middleware
+// chain. It deliberately exposes UserState as a flow.State rather than a
+// concrete type, so this package doesn't need to depend on the bot's
+// storage model.
+type Context struct {
+	userID      int64
+	chatID      int64
+	text        string
+	isCommand   bool
+	command     string
+	commandArgs string
+	state       flow.State
+
+	reply func(text string, opts ...ReplyOpt)
+	save  func()
+}
+
+// NewContext builds a Context for a single incoming update.
+func NewContext(
+	userID, chatID int64,
+	text string,
+	isCommand bool,
+	command string,
+	commandArgs string,
+	state flow.State,
+	reply func(text string, opts ...ReplyOpt),
+	save func(),
+) *Context {
+	return &Context{
+		userID:      userID,
+		chatID:      chatID,
+		text:        text,
+		isCommand:   isCommand,
+		command:     command,
+		commandArgs: commandArgs,
+		state:       state,
+		reply:       reply,
+		save:        save,
+	}
+}
+
+func (c *Context) UserID() int64         { return c.userID }
+func (c *Context) ChatID() int64         { return c.chatID }
+func (c *Context) Text() string          { return c.text }
+func (c *Context) IsCommand() bool       { return c.isCommand }
+func (c *Context) Command() string       { return c.command }
+func (c *Context) CommandArgs() string   { return c.commandArgs }
+func (c *Context) UserState() flow.State { return c.state }
+
+// Reply sends text back to the chat this update came from.
+func (c *Context) Reply(text string, opts ...ReplyOpt) {
+	c.reply(text, opts...)
+}
+
+// Save persists the current user's state.
+func (c *Context) Save() {
+	c.save()
+}
+
+// Handler processes a single update.
+type Handler func(ctx *Context) error
+
+// Middleware wraps a Handler with additional behaviour.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares around base, in the order they were given: the
+// first middleware passed runs outermost (sees the update first).
+func Chain(base Handler, mw ...Middleware) Handler {
+	h := base
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
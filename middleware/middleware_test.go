@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func testContext(userID int64) *Context {
+	return NewContext(userID, userID, "hi", false, "", "",
+		nil,
+		func(text string, opts ...ReplyOpt) {},
+		func() {},
+	)
+}
+
+func TestChainRunsInOrder(t *testing.T) {
+	var order []string
+
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx *Context) error {
+				order = append(order, name)
+				return next(ctx)
+			}
+		}
+	}
+
+	base := func(ctx *Context) error {
+		order = append(order, "base")
+		return nil
+	}
+
+	h := Chain(base, mark("first"), mark("second"))
+	if err := h(testContext(1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"first", "second", "base"}
+	if len(order) != len(want) {
+		t.Fatalf("expected order %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected order %v, got %v", want, order)
+		}
+	}
+}
+
+func TestRecoverStopsPanicPropagating(t *testing.T) {
+	h := Recover()(func(ctx *Context) error {
+		panic("boom")
+	})
+
+	if err := h(testContext(1)); err != nil {
+		t.Fatalf("expected Recover to swallow the panic, got err: %v", err)
+	}
+}
+
+func TestAllowlistDropsUnknownUsers(t *testing.T) {
+	var called bool
+	h := Allowlist(1, 2)(func(ctx *Context) error { called = true; return nil })
+
+	if err := h(testContext(3)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if called {
+		t.Fatalf("expected Allowlist to drop a user not in the list")
+	}
+
+	called = false
+	if err := h(testContext(1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Fatalf("expected Allowlist to pass through an allowed user")
+	}
+}
+
+func TestDenylistDropsListedUsers(t *testing.T) {
+	var called bool
+	h := Denylist(5)(func(ctx *Context) error { called = true; return nil })
+
+	if err := h(testContext(5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if called {
+		t.Fatalf("expected Denylist to drop a denied user")
+	}
+}
+
+func TestRateLimitDropsBurstsBeyondLimit(t *testing.T) {
+	var calls int
+	h := RateLimit(2, time.Minute)(func(ctx *Context) error { calls++; return nil })
+
+	for i := 0; i < 5; i++ {
+		if err := h(testContext(1)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls to pass the rate limiter, got %d", calls)
+	}
+}
+
+func TestRateLimitTracksUsersIndependently(t *testing.T) {
+	var calls int
+	h := RateLimit(1, time.Minute)(func(ctx *Context) error { calls++; return nil })
+
+	_ = h(testContext(1))
+	_ = h(testContext(2))
+	if calls != 2 {
+		t.Fatalf("expected each user to get its own budget, got %d calls", calls)
+	}
+}
+
+func TestLogPassesThroughError(t *testing.T) {
+	wantErr := errors.New("boom")
+	h := Log(log.New(new(discard), "", 0))(func(ctx *Context) error { return wantErr })
+
+	if err := h(testContext(1)); !errors.Is(err, wantErr) {
+		t.Fatalf("expected Log to pass through the error, got %v", err)
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
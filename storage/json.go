@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+type persistedData struct {
+	Users map[int64]*Record `json:"users"`
+}
+
+// JSONStorage persists all users as a single conversationbot.json file,
+// rewritten atomically (write to a temp file, then rename) on every save.
+type JSONStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewJSONStorage returns a Storage backed by a JSON file at path.
+func NewJSONStorage(path string) *JSONStorage {
+	return &JSONStorage{path: path}
+}
+
+func (s *JSONStorage) Load() (map[int64]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+func (s *JSONStorage) SaveUser(id int64, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.loadLocked()
+	if err != nil {
+		return err
+	}
+	users[id] = rec
+	return s.saveLocked(users)
+}
+
+func (s *JSONStorage) DeleteUser(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.loadLocked()
+	if err != nil {
+		return err
+	}
+	delete(users, id)
+	return s.saveLocked(users)
+}
+
+func (s *JSONStorage) Close() error { return nil }
+
+func (s *JSONStorage) loadLocked() (map[int64]*Record, error) {
+	data := persistedData{Users: make(map[int64]*Record)}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return data.Users, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	if data.Users == nil {
+		data.Users = make(map[int64]*Record)
+	}
+	return data.Users, nil
+}
+
+func (s *JSONStorage) saveLocked(users map[int64]*Record) error {
+	data := persistedData{Users: users}
+	b, err := json.MarshalIndent(&data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
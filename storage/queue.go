@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// writeQueueErrorBufferSize bounds how many persistent save failures
+// Errors() holds before further ones are dropped (and logged instead),
+// so a caller that never reads Errors() can't leak memory.
+const writeQueueErrorBufferSize = 64
+
+// WriteQueue wraps a Storage and coalesces bursts of SaveUser calls for the
+// same user into a single underlying write: if a save for a user is
+// already in flight, a newer SaveUser call just replaces the pending
+// record instead of starting a second, overlapping write.
+type WriteQueue struct {
+	backend Storage
+
+	mu       sync.Mutex
+	pending  map[int64]*Record
+	inFlight map[int64]bool
+	wg       sync.WaitGroup
+	errs     chan error
+}
+
+// NewWriteQueue wraps backend with per-user write coalescing. A write that
+// ultimately fails is always logged, and also offered on the returned
+// queue's Errors() channel so a caller that cares doesn't have to scrape
+// logs to notice a user's state silently failed to persist.
+func NewWriteQueue(backend Storage) *WriteQueue {
+	return &WriteQueue{
+		backend:  backend,
+		pending:  make(map[int64]*Record),
+		inFlight: make(map[int64]bool),
+		errs:     make(chan error, writeQueueErrorBufferSize),
+	}
+}
+
+// Errors returns persistent per-user save failures, i.e. backend.SaveUser
+// returning an error from inside flush. Reading it is optional.
+func (q *WriteQueue) Errors() <-chan error { return q.errs }
+
+func (q *WriteQueue) publishError(err error) {
+	select {
+	case q.errs <- err:
+	default:
+		log.Printf("storage: dropped write error, Errors() consumer too slow: %v", err)
+	}
+}
+
+func (q *WriteQueue) Load() (map[int64]*Record, error) {
+	return q.backend.Load()
+}
+
+// SaveUser queues rec to be written for id. It returns immediately; the
+// actual write happens asynchronously, and later calls for the same id
+// made before the previous write finishes simply replace the queued
+// record rather than running in parallel.
+func (q *WriteQueue) SaveUser(id int64, rec *Record) error {
+	q.mu.Lock()
+	q.pending[id] = rec
+	if q.inFlight[id] {
+		q.mu.Unlock()
+		return nil
+	}
+	q.inFlight[id] = true
+	q.wg.Add(1)
+	q.mu.Unlock()
+
+	go q.flush(id)
+	return nil
+}
+
+func (q *WriteQueue) flush(id int64) {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		rec, ok := q.pending[id]
+		delete(q.pending, id)
+		q.mu.Unlock()
+		if !ok {
+			break
+		}
+
+		if err := q.backend.SaveUser(id, rec); err != nil {
+			log.Printf("storage: error saving user %d: %v", id, err)
+			q.publishError(fmt.Errorf("storage: save user %d: %w", id, err))
+		}
+
+		q.mu.Lock()
+		if _, ok := q.pending[id]; !ok {
+			q.inFlight[id] = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *WriteQueue) DeleteUser(id int64) error {
+	q.mu.Lock()
+	delete(q.pending, id)
+	q.mu.Unlock()
+	return q.backend.DeleteUser(id)
+}
+
+// Close waits for any in-flight writes to finish, then closes the
+// underlying backend. No further sends to Errors() happen after this
+// returns, so it's safe for a caller to stop reading it.
+func (q *WriteQueue) Close() error {
+	q.wg.Wait()
+	close(q.errs)
+	return q.backend.Close()
+}
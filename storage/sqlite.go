@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/Lvntt/go-persistent-conversation-bot/history"
+	"github.com/Lvntt/go-persistent-conversation-bot/llm"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id           INTEGER PRIMARY KEY,
+	state        TEXT    NOT NULL DEFAULT '',
+	choice       TEXT    NOT NULL DEFAULT '',
+	data         JSON    NOT NULL DEFAULT '{}',
+	history      JSON    NOT NULL DEFAULT '{}',
+	lang         TEXT    NOT NULL DEFAULT '',
+	mode         TEXT    NOT NULL DEFAULT '',
+	chat_history JSON    NOT NULL DEFAULT '[]',
+	updated_at   INTEGER NOT NULL DEFAULT 0
+)`
+
+// sqliteBusyTimeoutMillis is how long a writer waits for a lock held by
+// another connection before giving up with SQLITE_BUSY.
+const sqliteBusyTimeoutMillis = 5000
+
+// SQLiteStorage persists users as rows in a SQLite database, via the
+// pure-Go modernc.org/sqlite driver so no CGO toolchain is required.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens (creating if necessary) a SQLite database at path
+// and ensures the users table exists. It enables WAL mode and a
+// busy_timeout so concurrent per-user writers (see WriteQueue) wait out a
+// held lock instead of failing immediately with SQLITE_BUSY, and caps the
+// pool at a single connection since modernc.org/sqlite doesn't serialize
+// writes across connections on its own.
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", path, sqliteBusyTimeoutMillis)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create users table: %w", err)
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+func (s *SQLiteStorage) Load() (map[int64]*Record, error) {
+	rows, err := s.db.Query(`SELECT id, state, choice, data, history, lang, mode, chat_history FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int64]*Record)
+	for rows.Next() {
+		var (
+			id                                         int64
+			state, choice, data, hist, lang, mode, chh string
+		)
+		if err := rows.Scan(&id, &state, &choice, &data, &hist, &lang, &mode, &chh); err != nil {
+			return nil, err
+		}
+		rec := &Record{State: state, Choice: choice, Lang: lang, Mode: mode}
+		if err := json.Unmarshal([]byte(data), &rec.Data); err != nil {
+			return nil, fmt.Errorf("decode data for user %d: %w", id, err)
+		}
+		var tree history.Tree
+		if err := json.Unmarshal([]byte(hist), &tree); err != nil {
+			return nil, fmt.Errorf("decode history for user %d: %w", id, err)
+		}
+		if len(tree.Messages) > 0 {
+			rec.History = &tree
+		}
+		if err := json.Unmarshal([]byte(chh), &rec.ChatHistory); err != nil {
+			return nil, fmt.Errorf("decode chat history for user %d: %w", id, err)
+		}
+		users[id] = rec
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteStorage) SaveUser(id int64, rec *Record) error {
+	data, err := json.Marshal(rec.Data)
+	if err != nil {
+		return err
+	}
+	tree := rec.History
+	if tree == nil {
+		tree = history.NewTree()
+	}
+	hist, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	chatHistory := rec.ChatHistory
+	if chatHistory == nil {
+		chatHistory = []llm.Message{}
+	}
+	chh, err := json.Marshal(chatHistory)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO users (id, state, choice, data, history, lang, mode, chat_history, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			state = excluded.state,
+			choice = excluded.choice,
+			data = excluded.data,
+			history = excluded.history,
+			lang = excluded.lang,
+			mode = excluded.mode,
+			chat_history = excluded.chat_history,
+			updated_at = excluded.updated_at`,
+		id, rec.State, rec.Choice, string(data), string(hist), rec.Lang, rec.Mode, string(chh), time.Now().Unix())
+	return err
+}
+
+func (s *SQLiteStorage) DeleteUser(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,47 @@
+// Package storage defines the persistence boundary for per-user bot state
+// and ships two backends: a JSON file (kept for compatibility with earlier
+// versions of the bot) and SQLite.
+package storage
+
+import (
+	"github.com/Lvntt/go-persistent-conversation-bot/history"
+	"github.com/Lvntt/go-persistent-conversation-bot/llm"
+)
+
+// Record is the persisted shape of a single user's conversation state. It
+// intentionally mirrors the wire format the JSON backend has always used,
+// so existing data files keep working.
+type Record struct {
+	State  string `json:"state"`
+	Choice string `json:"choice"`
+	Lang   string `json:"lang"`
+	// Data is the flat category->value map the bot persisted before
+	// History existed. It is only ever populated on records saved by an
+	// older version; callers migrate it into a History themselves (see
+	// history.FromFlatMap) and new saves leave it empty.
+	Data map[string]string `json:"data,omitempty"`
+	// History is the conversation's message tree. Nil (or empty) on
+	// records saved before history tracking existed.
+	History *history.Tree `json:"history,omitempty"`
+	// Mode is the top-level conversation mode ("" for the scripted profile
+	// flow, "chat" for free-form LLM conversation).
+	Mode string `json:"mode,omitempty"`
+	// ChatHistory is the free-form chat mode's message log. Empty unless
+	// the user has used /chat.
+	ChatHistory []llm.Message `json:"chat_history,omitempty"`
+}
+
+// Storage is the persistence interface the bot depends on. Callers should
+// prefer SaveUser/DeleteUser over re-saving the whole Load result, so a
+// single user's activity doesn't pay for every other user's state on each
+// write.
+type Storage interface {
+	// Load returns every persisted user, keyed by Telegram user ID.
+	Load() (map[int64]*Record, error)
+	// SaveUser persists a single user's state.
+	SaveUser(id int64, rec *Record) error
+	// DeleteUser removes a single user's state, if present.
+	DeleteUser(id int64) error
+	// Close releases any resources held by the backend.
+	Close() error
+}
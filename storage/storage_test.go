@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestJSONStorageSaveUserLoad(t *testing.T) {
+	dir := t.TempDir()
+	st := NewJSONStorage(filepath.Join(dir, "state.json"))
+
+	if err := st.SaveUser(42, &Record{State: "choosing", Data: map[string]string{"age": "30"}}); err != nil {
+		t.Fatalf("SaveUser error: %v", err)
+	}
+
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	rec, ok := users[42]
+	if !ok {
+		t.Fatalf("user 42 not found after save")
+	}
+	if rec.Data["age"] != "30" {
+		t.Fatalf("expected age 30, got %q", rec.Data["age"])
+	}
+}
+
+func TestJSONStorageDeleteUser(t *testing.T) {
+	dir := t.TempDir()
+	st := NewJSONStorage(filepath.Join(dir, "state.json"))
+
+	_ = st.SaveUser(1, &Record{Data: map[string]string{}})
+	if err := st.DeleteUser(1); err != nil {
+		t.Fatalf("DeleteUser error: %v", err)
+	}
+
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if _, ok := users[1]; ok {
+		t.Fatalf("expected user 1 to be removed")
+	}
+}
+
+func TestJSONStorageLoadNonExisting(t *testing.T) {
+	dir := t.TempDir()
+	st := NewJSONStorage(filepath.Join(dir, "no_such_file.json"))
+
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load should succeed for non-existing file, got error: %v", err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected empty users, got %d", len(users))
+	}
+}
+
+func TestSQLiteStorageSaveUserLoad(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewSQLiteStorage(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage error: %v", err)
+	}
+	defer st.Close()
+
+	if err := st.SaveUser(7, &Record{State: "choosing", Choice: "age", Data: map[string]string{"age": "31"}}); err != nil {
+		t.Fatalf("SaveUser error: %v", err)
+	}
+
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	rec, ok := users[7]
+	if !ok {
+		t.Fatalf("user 7 not found after save")
+	}
+	if rec.Choice != "age" || rec.Data["age"] != "31" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+
+	// Overwriting an existing user updates the row instead of adding another.
+	if err := st.SaveUser(7, &Record{State: "choosing", Data: map[string]string{"age": "32"}}); err != nil {
+		t.Fatalf("SaveUser (update) error: %v", err)
+	}
+	users, err = st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("expected 1 user after update, got %d", len(users))
+	}
+	if users[7].Data["age"] != "32" {
+		t.Fatalf("expected updated age 32, got %q", users[7].Data["age"])
+	}
+}
+
+func TestSQLiteStorageDeleteUser(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewSQLiteStorage(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage error: %v", err)
+	}
+	defer st.Close()
+
+	_ = st.SaveUser(1, &Record{Data: map[string]string{}})
+	if err := st.DeleteUser(1); err != nil {
+		t.Fatalf("DeleteUser error: %v", err)
+	}
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if _, ok := users[1]; ok {
+		t.Fatalf("expected user 1 to be removed")
+	}
+}
+
+// blockingStorage lets the write queue test control exactly when an
+// underlying SaveUser call completes, to exercise coalescing.
+type blockingStorage struct {
+	mu    sync.Mutex
+	saves []Record
+	block chan struct{}
+}
+
+func (b *blockingStorage) Load() (map[int64]*Record, error) { return nil, nil }
+
+func (b *blockingStorage) SaveUser(id int64, rec *Record) error {
+	<-b.block
+	b.mu.Lock()
+	b.saves = append(b.saves, *rec)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *blockingStorage) DeleteUser(id int64) error { return nil }
+func (b *blockingStorage) Close() error              { return nil }
+
+func TestWriteQueueCoalescesBurstsForSameUser(t *testing.T) {
+	backend := &blockingStorage{block: make(chan struct{})}
+	q := NewWriteQueue(backend)
+
+	_ = q.SaveUser(1, &Record{Data: map[string]string{"age": "1"}})
+	_ = q.SaveUser(1, &Record{Data: map[string]string{"age": "2"}})
+	_ = q.SaveUser(1, &Record{Data: map[string]string{"age": "3"}})
+
+	close(backend.block)
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.saves) != 1 {
+		t.Fatalf("expected bursts to coalesce into a single write, got %d", len(backend.saves))
+	}
+	if backend.saves[0].Data["age"] != "3" {
+		t.Fatalf("expected the latest record to win, got %q", backend.saves[0].Data["age"])
+	}
+}
+
+// failingStorage always fails SaveUser, to exercise WriteQueue.Errors().
+type failingStorage struct{}
+
+func (failingStorage) Load() (map[int64]*Record, error) { return nil, nil }
+func (failingStorage) SaveUser(int64, *Record) error    { return errors.New("disk full") }
+func (failingStorage) DeleteUser(int64) error           { return nil }
+func (failingStorage) Close() error                     { return nil }
+
+func TestWriteQueueSurfacesPersistentFailures(t *testing.T) {
+	q := NewWriteQueue(failingStorage{})
+
+	_ = q.SaveUser(1, &Record{})
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	select {
+	case err, ok := <-q.Errors():
+		if !ok || err == nil {
+			t.Fatalf("expected a persistent save failure on Errors(), got %v (ok=%v)", err, ok)
+		}
+	default:
+		t.Fatalf("expected a persistent save failure to be queued on Errors()")
+	}
+}
+
+func TestSQLiteStorageSurvivesConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewSQLiteStorage(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage error: %v", err)
+	}
+	defer st.Close()
+
+	const writers, writesPerWriter = 20, 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writesPerWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writesPerWriter; i++ {
+				rec := &Record{Data: map[string]string{"age": strconv.Itoa(i)}}
+				if err := st.SaveUser(int64(w), rec); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected concurrent write failure (busy_timeout should absorb this): %v", err)
+	}
+
+	users, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if len(users) != writers {
+		t.Fatalf("expected %d users, got %d", writers, len(users))
+	}
+}